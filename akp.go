@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem1024"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa44"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa65"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// The JOSE post-quantum drafts represent ML-DSA and ML-KEM keys with the AKP (algorithm key pair) key type, whose "alg" selects the parameter set, "pub" holds the encoded public key, and "priv" holds the seed from which the key pair is derived. jwx does not support this key type, so AKP keys are handled here, using circl for the key derivation.
+
+// ktyAKP is the AKP key type.
+const ktyAKP jwa.KeyType = "AKP"
+
+// akpScheme derives the public key of an AKP algorithm from a seed.
+type akpScheme struct {
+	seedSize int
+	derive   func(seed []byte) ([]byte, error)
+}
+
+var akpSchemes = map[string]akpScheme{
+	"ML-DSA-44":   {seedSize: mldsa44.SeedSize, derive: derivePub(mldsa44.Scheme().DeriveKey)},
+	"ML-DSA-65":   {seedSize: mldsa65.SeedSize, derive: derivePub(mldsa65.Scheme().DeriveKey)},
+	"ML-DSA-87":   {seedSize: mldsa87.SeedSize, derive: derivePub(mldsa87.Scheme().DeriveKey)},
+	"ML-KEM-768":  {seedSize: mlkem768.KeySeedSize, derive: derivePub(mlkem768.Scheme().DeriveKeyPair)},
+	"ML-KEM-1024": {seedSize: mlkem1024.KeySeedSize, derive: derivePub(mlkem1024.Scheme().DeriveKeyPair)},
+}
+
+// derivePub adapts the key derivation of a circl signature or KEM scheme to give the encoded public key.
+func derivePub[Pub interface{ MarshalBinary() ([]byte, error) }, Priv any](derive func([]byte) (Pub, Priv)) func([]byte) ([]byte, error) {
+	return func(seed []byte) ([]byte, error) {
+		pub, _ := derive(seed)
+		return pub.MarshalBinary()
+	}
+}
+
+// akpKey is an AKP key. The jwk.Key interface can only be implemented by embedding a jwx key, so the standard and custom properties are kept by an embedded OCT key whose own key material is a placeholder that is never exposed. Every method that exposes the kty or key material is overridden, including Iterate, Walk and AsMap.
+type akpKey struct {
+	jwk.Key
+	pub  []byte
+	priv []byte
+}
+
+// akpPlaceholder is the key material of the embedded OCT key, as jwx refuses empty OCT keys.
+var akpPlaceholder = []byte{0}
+
+func generateAKP(alg string, rand io.Reader) (jwk.Key, error) {
+	scheme, known := akpSchemes[alg]
+	if !known {
+		return nil, errors.New("unsupported post-quantum algorithm")
+	}
+	seed := make([]byte, scheme.seedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	return newAKPKey(alg, nil, seed)
+}
+
+// newAKPKey builds an AKP key from the public key pub, or the seed priv. When priv is given, pub is derived from it, and must match if also given.
+func newAKPKey(alg string, pub []byte, priv []byte) (*akpKey, error) {
+	scheme, known := akpSchemes[alg]
+	if !known {
+		return nil, errors.New("unsupported alg for AKP key")
+	}
+	if priv != nil {
+		if len(priv) != scheme.seedSize {
+			return nil, errors.New("invalid private key size for " + alg)
+		}
+		derived, err := scheme.derive(priv)
+		if err != nil {
+			return nil, err
+		}
+		if pub != nil && !bytes.Equal(pub, derived) {
+			return nil, errors.New("public key does not match private key")
+		}
+		pub = derived
+	} else if len(pub) == 0 {
+		return nil, errors.New("missing public key")
+	}
+
+	props, err := jwk.FromRaw(akpPlaceholder)
+	if err != nil {
+		return nil, err
+	}
+	if err = props.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, err
+	}
+	return &akpKey{Key: props, pub: pub, priv: priv}, nil
+}
+
+// parseAKPKey parses an AKP key from its JSON form.
+func parseAKPKey(data []byte) (*akpKey, error) {
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	alg, _ := obj[jwk.AlgorithmKey].(string)
+	if alg == "" {
+		return nil, errors.New("AKP key must have an alg field")
+	}
+	var members [2][]byte
+	for i, name := range []string{"pub", "priv"} {
+		value, found := obj[name]
+		if !found {
+			continue
+		}
+		str, isStr := value.(string)
+		if !isStr {
+			return nil, errors.New("AKP key " + name + " field must be a string")
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		members[i] = decoded
+		delete(obj, name)
+	}
+	key, err := newAKPKey(alg, members[0], members[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// Let jwx parse and validate the remaining properties, using the placeholder OCT key material
+	obj[jwk.KeyTypeKey] = jwa.OctetSeq.String()
+	obj["k"] = base64.RawURLEncoding.EncodeToString(akpPlaceholder)
+	enc, err := json.Marshal(obj)
+	if err != nil {
+		// this shouldn't be reachable, as obj comes from json.Unmarshal
+		panic(err)
+	}
+	if key.Key, err = jwk.ParseKey(enc); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parseKey is jwk.ParseKey with added support for AKP keys.
+func parseKey(data []byte) (jwk.Key, error) {
+	var probe struct {
+		Kty string `json:"kty"`
+	}
+	if err := json.Unmarshal(data, &probe); err == nil && probe.Kty == ktyAKP.String() {
+		return parseAKPKey(data)
+	}
+	return jwk.ParseKey(data)
+}
+
+// parseJWKs is jwk.Parse with added support for AKP keys.
+func parseJWKs(data []byte) (jwk.Set, error) {
+	var probe struct {
+		Kty  string            `json:"kty"`
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		// Leave it to jwx to report the error
+		return jwk.Parse(data)
+	}
+	if probe.Kty != "" {
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, err
+		}
+		set := jwk.NewSet()
+		return set, set.AddKey(key)
+	}
+	if !bytes.Contains(data, []byte(ktyAKP)) {
+		return jwk.Parse(data)
+	}
+	set := jwk.NewSet()
+	for _, raw := range probe.Keys {
+		key, err := parseKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err = set.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (k *akpKey) KeyType() jwa.KeyType {
+	return ktyAKP
+}
+
+func (k *akpKey) IsPrivate() bool {
+	return k.priv != nil
+}
+
+func (k *akpKey) Get(name string) (any, bool) {
+	switch name {
+	case jwk.KeyTypeKey:
+		return ktyAKP, true
+	case "pub":
+		return k.pub, true
+	case "priv":
+		return k.priv, k.priv != nil
+	case "k":
+		return nil, false
+	default:
+		return k.Key.Get(name)
+	}
+}
+
+func (k *akpKey) Set(name string, value any) error {
+	switch name {
+	case jwk.KeyTypeKey, "pub", "priv", "k":
+		return errors.New("cannot set the " + name + " field of an AKP key")
+	case jwk.AlgorithmKey:
+		// The alg selects the parameter set, so must not change
+		if alg, isAlg := value.(interface{ String() string }); isAlg && alg.String() == k.Algorithm().String() {
+			return nil
+		}
+		if alg, isStr := value.(string); isStr && alg == k.Algorithm().String() {
+			return nil
+		}
+		return errors.New("cannot change the alg field of an AKP key")
+	default:
+		return k.Key.Set(name, value)
+	}
+}
+
+func (k *akpKey) Raw(any) error {
+	return errors.New("AKP keys cannot be converted to raw keys")
+}
+
+func (k *akpKey) Clone() (jwk.Key, error) {
+	props, err := k.Key.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &akpKey{Key: props, pub: k.pub, priv: k.priv}, nil
+}
+
+func (k *akpKey) PublicKey() (jwk.Key, error) {
+	props, err := k.Key.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &akpKey{Key: props, pub: k.pub}, nil
+}
+
+// Thumbprint computes the thumbprint from the required members alg, kty and pub, as for RFC 7638.
+func (k *akpKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
+	enc, err := json.Marshal(map[string]string{
+		"alg": k.Algorithm().String(),
+		"kty": ktyAKP.String(),
+		"pub": base64.RawURLEncoding.EncodeToString(k.pub),
+	})
+	if err != nil {
+		// this shouldn't be reachable, as a map of strings is always marshalable
+		panic(err)
+	}
+	h := hash.New()
+	_, _ = h.Write(enc)
+	return h.Sum(nil), nil
+}
+
+// pairs gives the properties of the key, as seen through Get.
+func (k *akpKey) pairs(ctx context.Context) []*jwk.HeaderPair {
+	var pairs []*jwk.HeaderPair
+	for iter := k.Key.Iterate(ctx); iter.Next(ctx); {
+		pair := iter.Pair()
+		switch pair.Key {
+		case jwk.KeyTypeKey:
+			pairs = append(pairs, &jwk.HeaderPair{Key: jwk.KeyTypeKey, Value: ktyAKP})
+		case "k":
+		default:
+			pairs = append(pairs, pair)
+		}
+	}
+	pairs = append(pairs, &jwk.HeaderPair{Key: "pub", Value: k.pub})
+	if k.priv != nil {
+		pairs = append(pairs, &jwk.HeaderPair{Key: "priv", Value: k.priv})
+	}
+	return pairs
+}
+
+func (k *akpKey) Iterate(ctx context.Context) jwk.HeaderIterator {
+	return &akpIterator{pairs: k.pairs(ctx)}
+}
+
+func (k *akpKey) Walk(ctx context.Context, visitor jwk.HeaderVisitor) error {
+	for _, pair := range k.pairs(ctx) {
+		//nolint:forcetypeassert // The names of properties are always strings
+		if err := visitor.Visit(pair.Key.(string), pair.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *akpKey) AsMap(ctx context.Context) (map[string]any, error) {
+	obj := make(map[string]any)
+	for _, pair := range k.pairs(ctx) {
+		//nolint:forcetypeassert // The names of properties are always strings
+		obj[pair.Key.(string)] = pair.Value
+	}
+	return obj, nil
+}
+
+// akpIterator iterates over the properties of an AKP key, as jwx's iterators are only available for its own key types.
+type akpIterator struct {
+	pairs []*jwk.HeaderPair
+	next  int
+}
+
+func (it *akpIterator) Next(context.Context) bool {
+	if it.next >= len(it.pairs) {
+		return false
+	}
+	it.next++
+	return true
+}
+
+func (it *akpIterator) Pair() *jwk.HeaderPair {
+	return it.pairs[it.next-1]
+}
+
+func (k *akpKey) MarshalJSON() ([]byte, error) {
+	enc, err := json.Marshal(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]any
+	if err = json.Unmarshal(enc, &obj); err != nil {
+		return nil, err
+	}
+	delete(obj, "k")
+	obj[jwk.KeyTypeKey] = ktyAKP.String()
+	obj["pub"] = base64.RawURLEncoding.EncodeToString(k.pub)
+	if k.priv != nil {
+		obj["priv"] = base64.RawURLEncoding.EncodeToString(k.priv)
+	}
+	return json.Marshal(obj)
+}
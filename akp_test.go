@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestAKPKeyAsMap(t *testing.T) {
+	ctx := context.Background()
+	for alg := range akpSchemes {
+		t.Run(alg, func(t *testing.T) {
+			key, err := generateAKP(alg, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = key.Set(jwk.KeyIDKey, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if err = key.Set("x-custom", "value"); err != nil {
+				t.Fatal(err)
+			}
+			pub, _ := key.Get("pub")
+			priv, _ := key.Get("priv")
+
+			obj, err := key.AsMap(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj[jwk.KeyTypeKey] != ktyAKP {
+				t.Errorf("got kty %v, expected %s", obj[jwk.KeyTypeKey], ktyAKP)
+			}
+			if _, hasK := obj["k"]; hasK {
+				t.Error("expected no k field")
+			}
+			if !bytes.Equal(obj["pub"].([]byte), pub.([]byte)) || !bytes.Equal(obj["priv"].([]byte), priv.([]byte)) {
+				t.Error("expected the pub and priv fields of the key")
+			}
+
+			// Iterate and Walk see the same properties as AsMap
+			iterated := make(map[string]any)
+			for iter := key.Iterate(ctx); iter.Next(ctx); {
+				iterated[iter.Pair().Key.(string)] = iter.Pair().Value
+			}
+			walked := make(map[string]any)
+			_ = key.Walk(ctx, visitorFunc(func(name string, value any) error {
+				walked[name] = value
+				return nil
+			}))
+			for name, got := range map[string]map[string]any{"Iterate": iterated, "Walk": walked} {
+				if !maps.EqualFunc(got, obj, func(a, b any) bool { return jsonEqual(t, a, b) }) {
+					t.Errorf("got %v from %s, expected %v", got, name, obj)
+				}
+			}
+
+			// Encode the binary members as in a JWK, and parse the result back into a key
+			for _, name := range []string{"pub", "priv"} {
+				obj[name] = base64.RawURLEncoding.EncodeToString(obj[name].([]byte))
+			}
+			enc, err := json.Marshal(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parseKey(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := key.Thumbprint(crypto.SHA256)
+			got, _ := parsed.Thumbprint(crypto.SHA256)
+			parsedPriv, _ := parsed.Get("priv")
+			custom, _ := parsed.Get("x-custom")
+			if !bytes.Equal(got, want) || !bytes.Equal(parsedPriv.([]byte), priv.([]byte)) || parsed.KeyID() != "test" || custom != "value" {
+				t.Errorf("got %s after the round trip, expected %s", enc, must(json.Marshal(key)))
+			}
+
+			public, err := key.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj, _ = public.AsMap(ctx); obj["priv"] != nil || obj["pub"] == nil {
+				t.Errorf("got %v for the public key, expected pub but no priv", obj)
+			}
+		})
+	}
+}
+
+type visitorFunc func(string, any) error
+
+func (fn visitorFunc) Visit(name string, value any) error {
+	return fn(name, value)
+}
+
+// jsonEqual compares the values by their JSON encoding, as some property values aren't comparable.
+func jsonEqual(t *testing.T, a, b any) bool {
+	t.Helper()
+	return bytes.Equal(must(json.Marshal(a)), must(json.Marshal(b)))
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
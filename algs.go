@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// algSpec describes the key used with a JWA algorithm.
+type algSpec struct {
+	kty jwa.KeyType
+	// bits is the RSA modulus size or OCT key size used for new keys
+	bits int
+	// curves are the allowed curves for EC and OKP keys, with the curve used for new keys first
+	curves []jwa.EllipticCurveAlgorithm
+	use    jwk.KeyUsageType
+	ops    []jwk.KeyOperation
+}
+
+var (
+	signOps   = []jwk.KeyOperation{jwk.KeyOpSign, jwk.KeyOpVerify}
+	wrapOps   = []jwk.KeyOperation{jwk.KeyOpWrapKey, jwk.KeyOpUnwrapKey}
+	cryptOps  = []jwk.KeyOperation{jwk.KeyOpEncrypt, jwk.KeyOpDecrypt}
+	deriveOps = []jwk.KeyOperation{jwk.KeyOpDeriveKey, jwk.KeyOpDeriveBits}
+)
+
+// ECDH-ES works with both EC and OKP keys, so the curve decides the kty.
+var ecdhCurves = []jwa.EllipticCurveAlgorithm{jwa.P256, jwa.P384, jwa.P521, jwa.X25519, jwa.X448}
+
+// algSpecs are the algorithms supported by gen -alg. Algorithms that don't use a generated key, such as dir and PBES2, are omitted.
+//
+//nolint:mnd // no point in extracting these to constants
+var algSpecs = map[string]algSpec{
+	jwa.RS256.String(): {kty: jwa.RSA, bits: 2048, use: jwk.ForSignature, ops: signOps},
+	jwa.RS384.String(): {kty: jwa.RSA, bits: 3072, use: jwk.ForSignature, ops: signOps},
+	jwa.RS512.String(): {kty: jwa.RSA, bits: 4096, use: jwk.ForSignature, ops: signOps},
+	jwa.PS256.String(): {kty: jwa.RSA, bits: 2048, use: jwk.ForSignature, ops: signOps},
+	jwa.PS384.String(): {kty: jwa.RSA, bits: 3072, use: jwk.ForSignature, ops: signOps},
+	jwa.PS512.String(): {kty: jwa.RSA, bits: 4096, use: jwk.ForSignature, ops: signOps},
+
+	jwa.ES256.String():  {kty: jwa.EC, curves: []jwa.EllipticCurveAlgorithm{jwa.P256}, use: jwk.ForSignature, ops: signOps},
+	jwa.ES384.String():  {kty: jwa.EC, curves: []jwa.EllipticCurveAlgorithm{jwa.P384}, use: jwk.ForSignature, ops: signOps},
+	jwa.ES512.String():  {kty: jwa.EC, curves: []jwa.EllipticCurveAlgorithm{jwa.P521}, use: jwk.ForSignature, ops: signOps},
+	jwa.ES256K.String(): {kty: jwa.EC, curves: []jwa.EllipticCurveAlgorithm{crvSecp256k1}, use: jwk.ForSignature, ops: signOps},
+	jwa.EdDSA.String():  {kty: jwa.OKP, curves: []jwa.EllipticCurveAlgorithm{jwa.Ed25519, jwa.Ed448}, use: jwk.ForSignature, ops: signOps},
+
+	jwa.HS256.String(): {kty: jwa.OctetSeq, bits: 256, use: jwk.ForSignature, ops: signOps},
+	jwa.HS384.String(): {kty: jwa.OctetSeq, bits: 384, use: jwk.ForSignature, ops: signOps},
+	jwa.HS512.String(): {kty: jwa.OctetSeq, bits: 512, use: jwk.ForSignature, ops: signOps},
+
+	jwa.RSA1_5.String():       {kty: jwa.RSA, bits: 2048, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.RSA_OAEP.String():     {kty: jwa.RSA, bits: 2048, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.RSA_OAEP_256.String(): {kty: jwa.RSA, bits: 2048, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.RSA_OAEP_384.String(): {kty: jwa.RSA, bits: 3072, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.RSA_OAEP_512.String(): {kty: jwa.RSA, bits: 4096, use: jwk.ForEncryption, ops: wrapOps},
+
+	jwa.ECDH_ES.String():        {kty: jwa.EC, curves: ecdhCurves, use: jwk.ForEncryption, ops: deriveOps},
+	jwa.ECDH_ES_A128KW.String(): {kty: jwa.EC, curves: ecdhCurves, use: jwk.ForEncryption, ops: deriveOps},
+	jwa.ECDH_ES_A192KW.String(): {kty: jwa.EC, curves: ecdhCurves, use: jwk.ForEncryption, ops: deriveOps},
+	jwa.ECDH_ES_A256KW.String(): {kty: jwa.EC, curves: ecdhCurves, use: jwk.ForEncryption, ops: deriveOps},
+
+	jwa.A128KW.String():    {kty: jwa.OctetSeq, bits: 128, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.A192KW.String():    {kty: jwa.OctetSeq, bits: 192, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.A256KW.String():    {kty: jwa.OctetSeq, bits: 256, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.A128GCMKW.String(): {kty: jwa.OctetSeq, bits: 128, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.A192GCMKW.String(): {kty: jwa.OctetSeq, bits: 192, use: jwk.ForEncryption, ops: wrapOps},
+	jwa.A256GCMKW.String(): {kty: jwa.OctetSeq, bits: 256, use: jwk.ForEncryption, ops: wrapOps},
+
+	jwa.A128GCM.String():       {kty: jwa.OctetSeq, bits: 128, use: jwk.ForEncryption, ops: cryptOps},
+	jwa.A192GCM.String():       {kty: jwa.OctetSeq, bits: 192, use: jwk.ForEncryption, ops: cryptOps},
+	jwa.A256GCM.String():       {kty: jwa.OctetSeq, bits: 256, use: jwk.ForEncryption, ops: cryptOps},
+	jwa.A128CBC_HS256.String(): {kty: jwa.OctetSeq, bits: 256, use: jwk.ForEncryption, ops: cryptOps},
+	jwa.A192CBC_HS384.String(): {kty: jwa.OctetSeq, bits: 384, use: jwk.ForEncryption, ops: cryptOps},
+	jwa.A256CBC_HS512.String(): {kty: jwa.OctetSeq, bits: 512, use: jwk.ForEncryption, ops: cryptOps},
+
+	"ML-DSA-44":   {kty: ktyAKP, use: jwk.ForSignature, ops: signOps},
+	"ML-DSA-65":   {kty: ktyAKP, use: jwk.ForSignature, ops: signOps},
+	"ML-DSA-87":   {kty: ktyAKP, use: jwk.ForSignature, ops: signOps},
+	"ML-KEM-768":  {kty: ktyAKP, use: jwk.ForEncryption, ops: deriveOps},
+	"ML-KEM-1024": {kty: ktyAKP, use: jwk.ForEncryption, ops: deriveOps},
+}
+
+// ktyForCurve gives the kty of keys on the curve.
+func ktyForCurve(crv jwa.EllipticCurveAlgorithm) jwa.KeyType {
+	switch crv {
+	case jwa.Ed25519, jwa.Ed448, jwa.X25519, jwa.X448:
+		return jwa.OKP
+	default:
+		return jwa.EC
+	}
+}
+
+// opsForUse are the key_ops allowed with each use.
+var opsForUse = map[jwk.KeyUsageType][]jwk.KeyOperation{
+	jwk.ForSignature:  {jwk.KeyOpSign, jwk.KeyOpVerify},
+	jwk.ForEncryption: {jwk.KeyOpEncrypt, jwk.KeyOpDecrypt, jwk.KeyOpWrapKey, jwk.KeyOpUnwrapKey, jwk.KeyOpDeriveKey, jwk.KeyOpDeriveBits},
+}
+
+// privateOps are the key_ops that need the private key of an asymmetric key.
+var privateOps = []jwk.KeyOperation{jwk.KeyOpSign, jwk.KeyOpDecrypt, jwk.KeyOpUnwrapKey, jwk.KeyOpDeriveKey, jwk.KeyOpDeriveBits}
+
+// keyProps gives the alg, use and key_ops properties of a new key, checking their types and values so that mistakes are reported before any key is generated.
+func keyProps(props map[string]any) (string, jwk.KeyUsageType, []jwk.KeyOperation, error) {
+	var alg string
+	if value, haveAlg := props[jwk.AlgorithmKey]; haveAlg {
+		var isStr bool
+		if alg, isStr = value.(string); !isStr {
+			return "", "", nil, errors.New("alg field must be a string")
+		}
+	}
+	var use jwk.KeyUsageType
+	if value, haveUse := props[jwk.KeyUsageKey]; haveUse {
+		str, isStr := value.(string)
+		if _, known := opsForUse[jwk.KeyUsageType(str)]; !isStr || !known {
+			return "", "", nil, errors.New("use field must be sig or enc")
+		}
+		use = jwk.KeyUsageType(str)
+	}
+	var ops []jwk.KeyOperation
+	switch value := props[jwk.KeyOpsKey].(type) {
+	case nil:
+	case []jwk.KeyOperation:
+		// As set by --alg
+		ops = value
+	case []any:
+		for _, item := range value {
+			op, isStr := item.(string)
+			if !isStr {
+				return "", "", nil, errors.New("key_ops field must be a list of strings")
+			}
+			ops = append(ops, jwk.KeyOperation(op))
+		}
+	default:
+		return "", "", nil, errors.New("key_ops field must be a list of strings")
+	}
+	return alg, use, ops, nil
+}
+
+// validateProps checks that the alg, use and key_ops properties of a new key are consistent with each other and with the kind of key, so that inconsistencies are reported before any key is generated. The bits are the size of OCT keys. New keys always include their private part, so any operation the key is capable of is allowed.
+func validateProps(kty jwa.KeyType, crv jwa.EllipticCurveAlgorithm, bits int, alg string, use jwk.KeyUsageType, ops []jwk.KeyOperation) error {
+	// The operations the key is capable of, regardless of its properties
+	var capable []jwk.KeyOperation
+	switch {
+	case kty == jwa.RSA:
+		capable = slices.Concat(signOps, cryptOps, wrapOps)
+	case kty == jwa.EC:
+		capable = slices.Concat(signOps, deriveOps)
+	case crv == jwa.Ed25519, crv == jwa.Ed448:
+		capable = signOps
+	case crv == jwa.X25519, crv == jwa.X448:
+		capable = deriveOps
+	case kty == ktyAKP:
+		// The alg decides what an AKP key can do, and is always present
+		capable = algSpecs[alg].ops
+	default:
+		capable = slices.Concat(signOps, cryptOps, wrapOps, deriveOps)
+	}
+
+	if alg != "" {
+		spec, known := algSpecs[alg]
+		switch {
+		case known && len(spec.curves) > 0:
+			if !slices.Contains(spec.curves, crv) || kty != ktyForCurve(crv) {
+				return errors.New("alg field " + alg + " does not match the key's kty or crv")
+			}
+		case known:
+			if kty != spec.kty {
+				return errors.New("alg field " + alg + " does not match the key's kty")
+			}
+		case alg == jwa.DIRECT.String(), strings.HasPrefix(alg, "PBES2-"):
+			// These use the key as-is, so only need a symmetric key
+			spec = algSpec{kty: jwa.OctetSeq, use: jwk.ForEncryption}
+			if kty != spec.kty {
+				return errors.New("alg field " + alg + " does not match the key's kty")
+			}
+		default:
+			return errors.New("alg field " + alg + " is not a supported algorithm")
+		}
+		if kty == jwa.OctetSeq {
+			if algBits, exact, known := octBitsForAlg(alg); known && ((exact && bits != algBits) || bits < algBits) {
+				return errors.New("alg field " + alg + " does not match the key's size")
+			}
+		}
+		if use != "" && use != spec.use {
+			return errors.New("use field " + string(use) + " does not match the alg field " + alg)
+		}
+	}
+
+	for _, op := range ops {
+		switch {
+		case !slices.Contains(capable, op):
+			return errors.New("key_ops field " + string(op) + " is not supported by the key")
+		case use != "" && !slices.Contains(opsForUse[use], op):
+			return errors.New("key_ops field " + string(op) + " does not match the use field " + string(use))
+		}
+	}
+	return nil
+}
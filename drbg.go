@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"math/big"
+)
+
+// The standard library deliberately makes RSA and ECDSA key generation non-deterministic, even when given a deterministic source of randomness. The functions here generate keys purely from the bytes read from the source, and are only used for -insecure-deterministic key generation.
+
+// hmacDRBG is the HMAC_DRBG of NIST SP 800-90A using SHA-256, without reseeding or additional input.
+type hmacDRBG struct {
+	k []byte
+	v []byte
+}
+
+func newHMACDRBG(seed []byte, personalization []byte) *hmacDRBG {
+	drbg := &hmacDRBG{
+		k: make([]byte, sha256.Size),
+		v: make([]byte, sha256.Size),
+	}
+	for i := range drbg.v {
+		drbg.v[i] = 0x01
+	}
+	drbg.update(seed, personalization)
+	return drbg
+}
+
+func (d *hmacDRBG) update(data ...[]byte) {
+	var dataLen int
+	for _, b := range data {
+		dataLen += len(b)
+	}
+	for _, sep := range []byte{0x00, 0x01} {
+		mac := hmac.New(sha256.New, d.k)
+		mac.Write(d.v)
+		mac.Write([]byte{sep})
+		for _, b := range data {
+			mac.Write(b)
+		}
+		d.k = mac.Sum(nil)
+		mac = hmac.New(sha256.New, d.k)
+		mac.Write(d.v)
+		d.v = mac.Sum(nil)
+		if dataLen == 0 {
+			return
+		}
+	}
+}
+
+func (d *hmacDRBG) Read(p []byte) (int, error) {
+	for filled := 0; filled < len(p); {
+		mac := hmac.New(sha256.New, d.k)
+		mac.Write(d.v)
+		d.v = mac.Sum(nil)
+		filled += copy(p[filled:], d.v)
+	}
+	d.update()
+	return len(p), nil
+}
+
+// rsaPublicExponent is the exponent used by rsa.GenerateKey.
+const rsaPublicExponent = 65537
+
+func generateRSADeterministic(rand io.Reader, bits int) (*rsa.PrivateKey, error) {
+	pub := big.NewInt(rsaPublicExponent)
+	one := big.NewInt(1)
+	for {
+		p, err := generatePrimeDeterministic(rand, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := generatePrimeDeterministic(rand, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(pub, phi)
+		if d == nil {
+			// e is not coprime with phi, so try again with new primes
+			continue
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: rsaPublicExponent},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		if err = key.Validate(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// generatePrimeDeterministic returns a prime with exactly the given number of bits, and the top two bits set so that the product of two such primes has the combined number of bits.
+func generatePrimeDeterministic(rand io.Reader, bits int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8) //nolint:mnd // bits per byte, rounding up
+	for {
+		if _, err := io.ReadFull(rand, buf); err != nil {
+			return nil, err
+		}
+		candidate := new(big.Int).SetBytes(buf)
+		for i := bits; i < candidate.BitLen(); i++ {
+			candidate.SetBit(candidate, i, 0)
+		}
+		candidate.SetBit(candidate, bits-1, 1)
+		candidate.SetBit(candidate, bits-2, 1) //nolint:mnd // the second-highest bit
+		candidate.SetBit(candidate, 0, 1)
+		// ProbablyPrime derives its bases from the candidate, so is itself deterministic
+		//nolint:mnd // 20 rounds as used by crypto/rand.Prime
+		if candidate.ProbablyPrime(20) {
+			return candidate, nil
+		}
+	}
+}
+
+func generateECDSADeterministic(rand io.Reader, curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	var ecdhCurve ecdh.Curve
+	switch curve {
+	case elliptic.P256():
+		ecdhCurve = ecdh.P256()
+	case elliptic.P384():
+		ecdhCurve = ecdh.P384()
+	case elliptic.P521():
+		ecdhCurve = ecdh.P521()
+	}
+
+	order := curve.Params().N
+	buf := make([]byte, (order.BitLen()+7)/8) //nolint:mnd // bits per byte, rounding up
+	for {
+		if _, err := io.ReadFull(rand, buf); err != nil {
+			return nil, err
+		}
+		// Mask the excess bits, then reject values outside [1, n-1] to avoid bias
+		buf[0] &= byte(0xff >> (len(buf)*8 - order.BitLen())) //nolint:mnd // bits per byte
+		d := new(big.Int).SetBytes(buf)
+		if d.Sign() == 0 || d.Cmp(order) >= 0 {
+			continue
+		}
+
+		key := &ecdsa.PrivateKey{D: d}
+		key.Curve = curve
+		if ecdhCurve != nil {
+			ecdhKey, err := ecdhCurve.NewPrivateKey(buf)
+			if err != nil {
+				return nil, err
+			}
+			// The uncompressed point encoding is 0x04 followed by the X and Y coordinates
+			point := ecdhKey.PublicKey().Bytes()[1:]
+			key.X = new(big.Int).SetBytes(point[:len(point)/2])
+			key.Y = new(big.Int).SetBytes(point[len(point)/2:])
+		} else {
+			// Curves that aren't supported by crypto/ecdh, i.e. secp256k1, implement their own arithmetic
+			key.X, key.Y = curve.ScalarBaseMult(buf) //nolint:staticcheck // no alternative for non-NIST curves
+		}
+		return key, nil
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// TestHMACDRBG checks the DRBG against the first SHA-256 test vector without prediction resistance, personalization or additional input from the NIST CAVP HMAC_DRBG test vectors.
+func TestHMACDRBG(t *testing.T) {
+	entropy, _ := hex.DecodeString("ca851911349384bffe89de1cbdc46e6831e44d34a4fb935ee285dd14b71a7488")
+	nonce, _ := hex.DecodeString("659ba96c601dc69fc902940805ec0ca8")
+	expected, _ := hex.DecodeString("e528e9abf2dece54d47c7e75e5fe302149f817ea9fb4bee6f4199697d04d5b89" +
+		"d54fbb978a15b5c443c9ec21036d2460b6f73ebad0dc2aba6e624abf07745bc1" +
+		"07694bb7547bb0995f70de25d6b29e2d3011bb19d27676c07162c8b5ccde0668" +
+		"961df86803482cb37ed6d5c0bb8d50cf1f50d476aa0458bdaba806f48be9dcb8")
+
+	// The seed material is the entropy input followed by the nonce
+	drbg := newHMACDRBG(append(entropy, nonce...), nil)
+	out := make([]byte, len(expected))
+	// The vector's returned bits are the output of the second generate call
+	_, _ = drbg.Read(out)
+	_, _ = drbg.Read(out)
+	if !bytes.Equal(out, expected) {
+		t.Errorf("got %x, expected %x", out, expected)
+	}
+}
+
+// TestDeterministicKeys pins the keys generated from a fixed seed, which must never change, as users rely on -insecure-deterministic giving the same keys across versions. The kid is the RFC 7638 thumbprint of the key, and the private key is derived from the same random bytes as the public key, so the kid pins the whole key.
+func TestDeterministicKeys(t *testing.T) {
+	seedFile := filepath.Join(t.TempDir(), "seed")
+	if err := os.WriteFile(seedFile, []byte("jwknife known-answer test seed!!"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args []string
+		kid  string
+	}{
+		{args: []string{"-rsa=2048"}, kid: "XHftkMvV2pynyba3yLY7-LRG7tj_5hrgj5FsIUCLwL4"},
+		{args: []string{"-ec", "-setstr=crv=P-256"}, kid: "jEHxqZfZdCHto0SkNPQZ4wqCQDY6Uen_TH0OccDR7m8"},
+		{args: []string{"-ec", "-setstr=crv=P-384"}, kid: "gEFMqJ5p7UbkdGxVQ1SU6FGyytGOJQW5nAuewcbbXac"},
+		{args: []string{"-ec", "-setstr=crv=P-521"}, kid: "Z6W8wyi5DnRxZMCg_6puf8vOb_QTbzpopKhFL2L4VrY"},
+		{args: []string{"-okp", "-setstr=crv=Ed25519"}, kid: "YuVISm33WwLx6-RmqM6JdU6rAK7iURJJp-x3wysIK9I"},
+		{args: []string{"-okp", "-setstr=crv=X25519"}, kid: "h7StEf8uXpe_WgbFKTCePPGwV_1XxKLaPWA8CTd5_AU"},
+		{args: []string{"-okp", "-setstr=crv=Ed448"}, kid: "7yq9sYWQ1ImtnYzCNQT7Xzy510qLbqlBToTxf8gNZK4"},
+		{args: []string{"-okp", "-setstr=crv=X448"}, kid: "FU0v7opwrhHOSS9qzoFPThulNGe6mKVSkZ48cl1DbWE"},
+		{args: []string{"-oct=256"}, kid: "TVVjCKy3pvSHIhiwa6uGyGpwJ5fY0RSMitye4E2Lak4"},
+		{args: []string{"-pqc=ML-DSA-65"}, kid: "Fz8_nBVd-vhOvcIsRF80wc82IwXX-jZ9i9dcIryaBfA"},
+		{args: []string{"-pqc=ML-KEM-768"}, kid: "ts4G7UfUG_y6IMquEK9p_3n7doE1lM7R2TMsE6ZBE2E"},
+	} {
+		t.Run(test.args[len(test.args)-1], func(t *testing.T) {
+			run, err := prepareGen(append(test.args, "-seed.file="+seedFile, "-insecure-deterministic"), jwk.NewSet(), make(map[string]bool))
+			if err != nil {
+				t.Fatal(err)
+			}
+			set := jwk.NewSet()
+			if err = run(set); err != nil {
+				t.Fatal(err)
+			}
+			key, _ := set.Key(0)
+			if key.KeyID() != test.kid {
+				t.Errorf("got kid %s, expected %s", key.KeyID(), test.kid)
+			}
+		})
+	}
+}
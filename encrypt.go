@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwe"
+)
+
+// The JWE algorithms used to encrypt JWKs and JWK sets with a password.
+const (
+	passwordKeyAlg     = jwa.PBES2_HS512_A256KW
+	passwordContentAlg = jwa.A256GCM
+)
+
+// The content types of an encrypted JWK and JWK set, from RFC 7517.
+const (
+	ctyJWK    = "jwk+json"
+	ctyJWKSet = "jwk-set+json"
+)
+
+// minPasswordLength is the minimum length in bytes of a password used for encryption. The number of PBES2 iterations is fixed at 10000, which is cheap to brute force for short passwords.
+const minPasswordLength = 20
+
+// readPasswordFile reads a password from the file, without a single trailing newline.
+func readPasswordFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	password := trimNewline(string(contents))
+	if password == "" {
+		return nil, errors.New("password file " + path + " is empty")
+	}
+	return []byte(password), nil
+}
+
+// encryptWithPassword encrypts the content as a JWE in compact serialization, deriving the key from the password with PBES2.
+func encryptWithPassword(content []byte, password []byte, cty string) ([]byte, error) {
+	headers := jwe.NewHeaders()
+	if err := headers.Set(jwe.ContentTypeKey, cty); err != nil {
+		return nil, err
+	}
+	return jwe.Encrypt(content,
+		jwe.WithKey(passwordKeyAlg, password),
+		jwe.WithContentEncryption(passwordContentAlg),
+		jwe.WithProtectedHeaders(headers),
+	)
+}
+
+// decryptWithPassword decrypts a JWE encrypted by encryptWithPassword, checking that the content is a JWK or JWK set.
+func decryptWithPassword(data []byte, password []byte) ([]byte, error) {
+	msg := jwe.NewMessage()
+	content, err := jwe.Decrypt(bytes.TrimSpace(data), jwe.WithKey(passwordKeyAlg, password), jwe.WithMessage(msg))
+	if err != nil {
+		return nil, err
+	}
+	// The cty may also be given as a full media type
+	cty := strings.TrimPrefix(strings.ToLower(msg.ProtectedHeaders().ContentType()), "application/")
+	if cty != ctyJWK && cty != ctyJWKSet {
+		return nil, errors.New("encrypted content is not a JWK or JWK set")
+	}
+	return content, nil
+}
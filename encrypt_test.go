@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestWriteEncryptPassword(t *testing.T) {
+	set := jwk.NewSet()
+	if err := handleGen([]string{"-alg=ES256", "-setstr=kid=test"}, set); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{name: "minimum length", password: strings.Repeat("p", minPasswordLength)},
+		{name: "trailing newline", password: strings.Repeat("p", minPasswordLength) + "\n"},
+		{name: "too short", password: strings.Repeat("p", minPasswordLength-1), wantErr: "is too short, must be at least 20 bytes"},
+		// The trailing newline doesn't count towards the length
+		{name: "too short with newline", password: strings.Repeat("p", minPasswordLength-1) + "\n", wantErr: "is too short"},
+		{name: "empty", password: "", wantErr: "is empty"},
+		{name: "only newline", password: "\n", wantErr: "is empty"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			passwordFile := filepath.Join(dir, "password")
+			if err := os.WriteFile(passwordFile, []byte(test.password), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "keys.jwe")
+			err := handleWrite([]string{"-fullkey", "-encrypt.password.file=" + passwordFile, "-path=" + path}, set)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, expected it to contain %q", err, test.wantErr)
+				}
+				if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+					t.Error("expected no file to be written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read := jwk.NewSet()
+			if err = handleRead([]string{"-decrypt.password.file=" + passwordFile, "-path=" + path}, read); err != nil {
+				t.Fatal(err)
+			}
+			if key, _ := read.Key(0); read.Len() != 1 || key.KeyID() != "test" {
+				t.Errorf("got %d keys, expected the written key", read.Len())
+			}
+		})
+	}
+}
@@ -19,11 +19,17 @@ func addValueFlag[T any](fs flagset, name string, parse func(string) (T, error))
 	return flag
 }
 
+// addOptionalValueFlag adds a flag that may be given with or without a value. Without a value, the flag is set but keeps the zero value.
+func addOptionalValueFlag[T any](fs flagset, name string, parse func(string) (T, error)) *valflag[T] {
+	flag := &valflag[T]{Name: name, Parse: parse, Optional: true}
+	fs.addFlag(name, flag.Iface())
+	return flag
+}
+
 func addUnparsedFlag(fs flagset, name string) *valflag[string] {
 	return addValueFlag[string](fs, name, func(v string) (string, error) { return v, nil })
 }
 
-//nolint:unused // Worth keeping? eh
 func addSliceFlag[T any](fs flagset, name string, parse func(string) (T, error)) *valflag[[]T] {
 	flag := &valflag[[]T]{
 		Name: name,
@@ -46,7 +52,6 @@ func addSliceFlag[T any](fs flagset, name string, parse func(string) (T, error))
 	return flag
 }
 
-//nolint:unused // Worth keeping? eh
 func addUnparsedSliceFlag(fs flagset, name string) *valflag[[]string] {
 	return addSliceFlag[string](fs, name, func(s string) (string, error) {
 		return s, nil
@@ -71,11 +76,12 @@ func addExternalFlag(fs flagset, name string, handle func(val string) error) *va
 type novalue struct{}
 
 type valflag[T any] struct {
-	Name   string
-	IsSet  bool
-	Value  T
-	Parse  func(string) (T, error)
-	Update func(T, string) (T, error)
+	Name     string
+	IsSet    bool
+	Value    T
+	Parse    func(string) (T, error)
+	Update   func(T, string) (T, error)
+	Optional bool
 }
 
 func (f *valflag[T]) Set() error {
@@ -83,7 +89,7 @@ func (f *valflag[T]) Set() error {
 		return errors.New("duplicate flag --" + f.Name)
 	}
 	f.IsSet = true
-	if any(f.Value) != any(novalue{}) {
+	if any(f.Value) != any(novalue{}) && !f.Optional {
 		return errors.New("missing value for --" + f.Name)
 	}
 	return nil
@@ -5,9 +5,19 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
@@ -15,28 +25,111 @@ import (
 )
 
 var genSyntax = strings.TrimSpace(`
-gen [-rsa=bits] [-ec] [-okp] [-setstr=key=str] [-setjson=key=json]
+gen [-spec=path] [-rsa=bits] [-ec] [-okp] [-oct[=bits]] [-pqc=alg] [-alg=alg] [-like=kid] [-count=n] [-kid=strategy] [-lax] [-stamp] [-valid-for=duration] [-stamp.prefix=prefix] [-oct.derive=kdf -oct.derive.secret.file=path|-oct.derive.secret.env=var [-oct.derive.salt=salt] [-oct.derive.info=info]] [-seed.file=path -insecure-deterministic] [-x509.subject=dn] [-x509.validity=duration] [-x509.san=name] [-x509.keyusage=usage[,...]] [-setstr=key=str] [-setjson=key=json] [-setfile=key=path] [-setjsonfile=key=path] [-setenv=key=var]
 `)
 
 var genSummary = strings.TrimSpace(`
 Generate and append a key to the JWK set.
 
-Key generation takes its parameters from the key's properties where possible. Specifically, EC and OKP keys use the "alg" and/or "crv" fields to determine which elliptic curve to use.
+Multiple keys with the same properties can be generated at once using -count, in which case the keys are generated concurrently. Each key gets its own "kid" (see -kid below), so the "kid" property cannot be set when generating more than one key.
 
-The private key is added to the JWK set during generation. To get just the public key, use the corresponding flags on the write command when writing keys.
+The strategy used to assign the "kid" of keys generated without one is chosen with -kid. The thumbprint-sha256 strategy (the default) and thumbprint-sha1 use the base64url-encoded RFC 7638 thumbprint of the key. The uuid strategy uses a random version 4 UUID, and ulid uses a ULID with the current time. The timestamp strategy uses the current UTC time, such as 20060102T150405Z. A template:<tpl> strategy executes the Go text/template <tpl> with the fields .alg, .kty, .crv, .date (the current UTC date, such as 2006-01-02) and .thumbprint (the first 8 characters of the SHA-256 thumbprint), for example -kid=template:{{.kty}}-{{.date}}-{{.thumbprint}}. Fields that don't apply to the key, such as .crv for RSA keys, are empty. When generating more than one key, the strategy must give each key a different "kid", so the timestamp strategy and templates without .thumbprint cannot be used with -count. The uuid and ulid strategies are random even with -insecure-deterministic.
 
-Properties of the key are set using -setstr or -setjson. The "kty" property cannot be modified. Minimal validation is applied to properties; standard JWK properties must have the correct primitive type.
+Key generation takes its parameters from the key's properties where possible. Specifically, EC and OKP keys use the "alg" and/or "crv" fields to determine which elliptic curve to use, and OCT keys use the "alg" field to determine the key size if no size is given. OKP keys support the Ed25519, X25519, Ed448 and X448 curves, with the "alg" defaulting to EdDSA, or ECDH-ES for X25519 and X448. The secp256k1 curve (alg ES256K) is only available when jwknife is built with -tags jwx_es256k.
+
+To generate another key just like an existing one, such as during key rotation, use -like with the "kid" of a key in the set. The new key gets the same kty and size or curve, and a copy of every property except the "kid", the key material, the certificate, the -oct.derive parameters, and the times recorded by -stamp and -valid-for. The size can be changed by also giving -rsa or -oct, and any property can be overridden with -setstr or -setjson.
+
+Several kinds of keys can be generated in one step from a spec file using -spec, which cannot be combined with other flags. The file is a JSON or YAML document with a "keys" list, where each entry has the optional fields "kty" (RSA, EC, OKP, oct or AKP), "size" (for RSA and oct keys), "crv", "alg", "use", "kid" (a -kid strategy), "count" (at least 1, defaulting to 1) and "props" (an object of further properties). Each entry is equivalent to the corresponding flags, for example "alg" to -alg and "props" to -setjson, and every entry is validated before any keys are generated, including that no two entries give the same fixed or shared "kid". For example:
+
+	keys:
+	  - alg: RS256
+	    count: 2
+	    props: {x-team: payments}
+	  - kty: EC
+	    crv: P-384
+
+Post-quantum keys for the ML-DSA-44, ML-DSA-65, ML-DSA-87, ML-KEM-768 and ML-KEM-1024 algorithms are generated with -pqc. These keys use the AKP key type from the JOSE post-quantum drafts, with the "alg" property giving the algorithm, "pub" the public key, and "priv" the seed from which the key is derived. As the drafts may still change, these keys are intended for pilots and interoperability testing.
+
+Alternatively, -alg generates a key for the given JWS or JWE algorithm, without giving -rsa, -ec, -okp, -oct or -pqc. It sets the "alg", "use" and "key_ops" properties, and picks the kty and a sensible size or curve for the algorithm: 2048-bit RSA keys for RS256, PS256 and RSA-OAEP, 3072 and 4096 bits for the 384 and 512 variants, the matching curve for ES*, Ed25519 for EdDSA, P-256 for ECDH-ES*, the required size for OCT keys, and an AKP key for the algorithms supported by -pqc. A different size or curve can still be chosen with -rsa, -oct or the "crv" property, but properties or flags that conflict with the algorithm are rejected. For ECDH-ES*, setting "crv" to X25519 or X448 generates an OKP key. Algorithms that don't use a key of their own, such as dir and PBES2*, are not supported.
+
+For test fixtures, keys can be derived deterministically from a seed using -seed.file and -insecure-deterministic, so that the same command line always generates the same keys. The key material is then produced by a HMAC-DRBG (NIST SP 800-90A) seeded from the file instead of the system's secure random number generator. Anyone with the seed can recreate the keys, so never use this for keys that protect anything of value.
+
+To keep track of when keys were created and when they should be retired, -stamp records the time of generation in the "x-jwknife-iat" property, and -valid-for records the time of generation and the end of the given validity period in the "x-jwknife-nbf" and "x-jwknife-exp" properties. Like the "iat", "nbf" and "exp" claims of a JWT, the times are NumericDate values, that is, the number of seconds since 1970-01-01T00:00:00Z. The write command's -drop-expired removes keys whose "x-jwknife-exp" time has passed, and other tools can use the properties to decide when to rotate keys. They can be removed when publishing keys using -strip on the write command. The "x-jwknife-" prefix can be changed using -stamp.prefix, and the same prefix must then be given to write -drop-expired.prefix.
+
+Reproducible OCT keys, such as for local development environments, can be derived from a shared secret with -oct.derive, using the hkdf (HKDF-SHA256), pbkdf2 (PBKDF2-HMAC-SHA256 with 600000 iterations) or argon2id (Argon2id with 3 passes, 64 MiB of memory and 4 threads) key derivation function. The secret is read from a file with -oct.derive.secret.file, without a single trailing newline, or from an environment variable with -oct.derive.secret.env, so that it isn't visible in the process list. The salt given by -oct.derive.salt is required for pbkdf2 and argon2id, and -oct.derive.info can give the HKDF info. The key derivation function and its non-secret parameters are recorded in the "x-jwknife-derive" property, so that the key can be derived again later from the same secret.
+
+Consumers that need a certificate for every key can be given one with -x509.subject, which creates a self-signed certificate for each generated key and sets its "x5c", "x5t" and "x5t#S256" properties, so these cannot also be set with -setstr and the like. The subject is a distinguished name such as CN=example,O=Example Corp, using the attribute types CN, O, OU, C, L, ST, STREET, POSTALCODE and SERIALNUMBER. Certificates can only be created for RSA, EC (other than secp256k1) and Ed25519 keys. The certificate's serial number and validity period are never deterministic, even with -insecure-deterministic.
+
+The private key is added to the JWK set during generation. To get just the public key, use the corresponding flags on the write command when writing keys. OCT keys are symmetric, so have no public key.
+
+Properties of the key are set using -setstr or -setjson, or from the contents of a file using -setfile or -setjsonfile, or from an environment variable using -setenv. Reading values from files or the environment keeps long values such as "x5c" chains out of the command line, as well as secrets, which would otherwise be visible to other users in the process list. Each property can only be set once. The "kty" property cannot be modified. Standard JWK properties must have the correct primitive type. The "alg", "use" and "key_ops" properties must also be consistent: the "alg" must be a known algorithm for the key's kty, curve and (for OCT keys) size, the "use" must match the "alg", and each of the "key_ops" must match the "use" and be an operation the key can perform, for example no "encrypt" for Ed25519 keys. Use -lax to skip these consistency checks.
 `)
 
 var genFlags = strings.TrimSpace(`
 -rsa=bits         Generate an RSA key with the given bit length.
 -ec               Generate an EC key.
 -okp              Generate an OKP key.
+-oct[=bits]       Generate an OCT (symmetric) key with the given bit length.
+-pqc=alg          Generate a post-quantum AKP key for the given ML-DSA or ML-KEM algorithm.
+-alg=alg          Generate a key for the given JWA algorithm, setting the alg, use and key_ops
+                  properties.
+-like=kid         Generate a key of the same kind and with the same properties as the key with the
+                  given kid, apart from its key material, kid and certificate.
+-spec=path        Generate the keys described by the JSON or YAML spec file.
+-count=n          Generate n keys with the same properties. Defaults to 1.
+-kid=strategy     How to assign the "kid" property: thumbprint-sha256, thumbprint-sha1, uuid, ulid,
+                  timestamp or template:<tpl>. Defaults to thumbprint-sha256.
+-lax              Skip the consistency checks of the alg, use and key_ops properties.
+-stamp            Record the time of generation in the "x-jwknife-iat" property.
+-valid-for=duration
+                  Record the time of generation and the end of the validity period in the
+                  "x-jwknife-nbf" and "x-jwknife-exp" properties.
+-stamp.prefix=prefix
+                  The prefix of the properties recorded by -stamp and -valid-for. Defaults to
+                  x-jwknife-.
+-oct.derive=kdf   Derive the OCT key from a secret using hkdf, pbkdf2 or argon2id, instead of generating
+                  it randomly.
+-oct.derive.secret.file=path
+                  Read the secret for -oct.derive from the file, without a single trailing newline.
+-oct.derive.secret.env=var
+                  Read the secret for -oct.derive from the environment variable.
+-oct.derive.salt=salt
+                  The salt for -oct.derive. Required for pbkdf2 and argon2id.
+-oct.derive.info=info
+                  The info for -oct.derive=hkdf.
+-seed.file=path   Derive the keys from the contents of the file instead of generating them randomly.
+                  The file must contain at least 32 bytes. Requires -insecure-deterministic.
+-insecure-deterministic
+                  Allow deterministic key generation with -seed.file.
+-x509.subject=dn  Create a self-signed certificate with the given subject distinguished name.
+-x509.validity=duration
+                  The validity period of the certificate. Defaults to 8760h (365 days).
+-x509.san=name    Add a subject alternative name to the certificate. IP addresses, URIs (containing
+                  ://) and email addresses (containing @) are detected; anything else is a DNS name.
+                  May be repeated.
+-x509.keyusage=usage[,...]
+                  The key usages of the certificate, from digitalSignature, contentCommitment,
+                  keyEncipherment, dataEncipherment, keyAgreement, keyCertSign and cRLSign. Defaults
+                  to digitalSignature, plus keyEncipherment for RSA keys.
 -setstr=key=str   Set the given property to the (unparsed) string value.
 -setjson=key=json Parse the value as JSON and set the given property to the value.
+-setfile=key=path Set the given property to the contents of the file as a string, without a single
+                  trailing newline.
+-setjsonfile=key=path
+                  Parse the contents of the file as JSON and set the given property to the value.
+-setenv=key=var   Set the given property to the value of the environment variable as a string.
 `)
 
 func handleGen(args []string, set jwk.Set) error {
+	run, err := prepareGen(args, set, make(map[string]bool))
+	if err != nil {
+		return err
+	}
+	return run(set)
+}
+
+// prepareGen parses and validates the arguments of gen, returning a function that generates the keys into a set. The given set is only used to look up existing keys. Kids that are known before generating keys are recorded in kids, to catch duplicates across the entries of a spec.
+func prepareGen(args []string, set jwk.Set, kids map[string]bool) (func(set jwk.Set) error, error) {
 	var (
 		genflags = flagset{}
 		rsabits  = addValueFlag[int](genflags, "rsa", func(s string) (int, error) {
@@ -54,33 +147,73 @@ func handleGen(args []string, set jwk.Set) error {
 		})
 		ec    = addNoValueFlag(genflags, "ec") //nolint:varnamelen // This is fine
 		okp   = addNoValueFlag(genflags, "okp")
-		props = make(map[string]any)
-		_     = addExternalFlag(genflags, "setstr", func(value string) error {
-			name, value, found := strings.Cut(value, "=")
-			if !found {
-				return errors.New("--set value must be key=value format")
+		oct   = addOptionalValueFlag[int](genflags, "oct", parseOctBits)
+		pqc   = addValueFlag[string](genflags, "pqc", parsePQCAlg)
+		alg   = addValueFlag[string](genflags, "alg", parseGenAlg)
+		count = addValueFlag[int](genflags, "count", func(s string) (int, error) {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return 0, err
 			}
-			if _, exists := props[value]; exists {
-				return errors.New("duplicate --set key")
+			if n < 1 {
+				return 0, errors.New("value for --count must be at least 1")
 			}
-			props[name] = value
-			return nil
+			return n, nil
+		})
+		kid   = addValueFlag[kidStrategy](genflags, "kid", parseKidStrategy)
+		lax   = addNoValueFlag(genflags, "lax")
+		spec  = addUnparsedFlag(genflags, "spec")
+		like  = addUnparsedFlag(genflags, "like")
+		props = make(map[string]any)
+		_     = addExternalFlag(genflags, "setstr", func(value string) error {
+			return setProp(props, value, func(value string) (any, error) { return value, nil })
 		})
 		_ = addExternalFlag(genflags, "setjson", func(value string) error {
-			name, value, found := strings.Cut(value, "=")
-			if !found {
-				return errors.New("--set value must be key=value format")
-			}
-			if _, exists := props[value]; exists {
-				return errors.New("duplicate --set key")
-			}
-			var obj any
-			if err := json.Unmarshal([]byte(value), &obj); err != nil {
-				return err
-			}
-			props[name] = obj
-			return nil
+			return setProp(props, value, parseJSONProp)
 		})
+		_ = addExternalFlag(genflags, "setfile", func(value string) error {
+			return setProp(props, value, func(path string) (any, error) {
+				contents, err := os.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				return trimNewline(string(contents)), nil
+			})
+		})
+		_ = addExternalFlag(genflags, "setjsonfile", func(value string) error {
+			return setProp(props, value, func(path string) (any, error) {
+				contents, err := os.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				return parseJSONProp(string(contents))
+			})
+		})
+		_ = addExternalFlag(genflags, "setenv", func(value string) error {
+			return setProp(props, value, func(name string) (any, error) {
+				env, found := os.LookupEnv(name)
+				if !found {
+					return nil, errors.New("environment variable " + name + " is not set")
+				}
+				return env, nil
+			})
+		})
+		derive        = addValueFlag[string](genflags, "oct.derive", parseKDF)
+		deriveSalt    = addUnparsedFlag(genflags, "oct.derive.salt")
+		deriveInfo    = addUnparsedFlag(genflags, "oct.derive.info")
+		deriveFile    = addUnparsedFlag(genflags, "oct.derive.secret.file")
+		deriveEnv     = addUnparsedFlag(genflags, "oct.derive.secret.env")
+		stamp         = addNoValueFlag(genflags, "stamp")
+		validFor      = addValueFlag[time.Duration](genflags, "valid-for", parseNonNegativeDuration)
+		stampPrefix   = addUnparsedFlag(genflags, "stamp.prefix")
+		seedFile      = addUnparsedFlag(genflags, "seed.file")
+		deterministic = addNoValueFlag(genflags, "insecure-deterministic")
+
+		certOpts = certOptions{validity: defaultCertValidity}
+		subject  = addValueFlag[pkix.Name](genflags, "x509.subject", parseDistinguishedName)
+		validity = addValueFlag[time.Duration](genflags, "x509.validity", parseNonNegativeDuration)
+		_        = addExternalFlag(genflags, "x509.san", certOpts.addSubjectAltName)
+		keyUsage = addValueFlag[x509.KeyUsage](genflags, "x509.keyusage", parseKeyUsage)
 	)
 
 	for _, arg := range args {
@@ -96,20 +229,143 @@ func handleGen(args []string, set jwk.Set) error {
 			err = flag.SetValue(value)
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if err := oneOf(false, rsabits.Iface(), ec.Iface(), okp.Iface()); err != nil {
-		return err
+	if spec.IsSet {
+		for name, flag := range genflags {
+			if name != "spec" && flag.IsSet() {
+				return nil, errors.New("--spec cannot be combined with --" + name)
+			}
+		}
+		return prepareGenSpec(spec.Value, set, kids)
+	}
+
+	if stampPrefix.IsSet && !stamp.IsSet && !validFor.IsSet {
+		return nil, errors.New("--stamp.prefix requires --stamp or --valid-for")
+	}
+	if validFor.IsSet && validFor.Value == 0 {
+		return nil, errors.New("value for --valid-for must be positive")
+	}
+	if !stampPrefix.IsSet {
+		stampPrefix.Value = defaultStampPrefix
+	} else if stampPrefix.Value == "" {
+		return nil, errors.New("value for --stamp.prefix must not be empty")
+	}
+	stampParams := []string{stampPrefix.Value + "iat", stampPrefix.Value + "nbf", stampPrefix.Value + "exp"}
+
+	kinds := map[jwa.KeyType]flag{
+		jwa.RSA:      rsabits.Iface(),
+		jwa.EC:       ec.Iface(),
+		jwa.OKP:      okp.Iface(),
+		jwa.OctetSeq: oct.Iface(),
+		ktyAKP:       pqc.Iface(),
+	}
+	if err := oneOf(true, like.Iface(), alg.Iface()); err != nil {
+		return nil, err
+	}
+	if like.IsSet {
+		if err := applyLike(like.Value, set, props, kinds, stampParams); err != nil {
+			return nil, err
+		}
+	}
+	if alg.IsSet {
+		if err := applyAlgSpec(alg.Value, props, kinds); err != nil {
+			return nil, err
+		}
+	}
+	if err := oneOf(false, rsabits.Iface(), ec.Iface(), okp.Iface(), oct.Iface(), pqc.Iface()); err != nil {
+		return nil, err
+	}
+	if !count.IsSet {
+		count.Value = 1
+	}
+
+	// The times are recorded as NumericDate values, as for the claims of a JWT
+	now := time.Now().Unix()
+	stamps := make(map[string]any)
+	if stamp.IsSet {
+		stamps[stampParams[0]] = now
+	}
+	if validFor.IsSet {
+		stamps[stampParams[1]] = now
+		stamps[stampParams[2]] = now + int64(validFor.Value/time.Second)
+	}
+	for name, value := range stamps {
+		if _, exists := props[name]; exists {
+			return nil, errors.New("cannot set " + name + " field with --stamp or --valid-for")
+		}
+		props[name] = value
+	}
+	if seedFile.IsSet != deterministic.IsSet {
+		return nil, errors.New("--seed.file and --insecure-deterministic must be given together")
+	}
+	if derive.IsSet {
+		switch {
+		case !oct.IsSet:
+			return nil, errors.New("--oct.derive requires an OCT key")
+		case count.Value > 1:
+			return nil, errors.New("cannot use --count with --oct.derive, every key would be the same")
+		case seedFile.IsSet:
+			return nil, errors.New("cannot specify both --oct.derive and --seed.file")
+		}
 	}
 
+	for name, flag := range genflags {
+		if strings.HasPrefix(name, "x509.") && flag.IsSet() && !subject.IsSet {
+			return nil, errors.New("--" + name + " requires --x509.subject")
+		}
+		if strings.HasPrefix(name, "oct.derive.") && flag.IsSet() && !derive.IsSet {
+			return nil, errors.New("--" + name + " requires --oct.derive")
+		}
+	}
+	if validity.IsSet && validity.Value == 0 {
+		return nil, errors.New("value for --x509.validity must be positive")
+	}
+	if subject.IsSet {
+		for _, name := range []string{jwk.X509CertChainKey, jwk.X509CertThumbprintKey, jwk.X509CertThumbprintS256Key} {
+			if _, exists := props[name]; exists {
+				return nil, errors.New("cannot set " + name + " field with --x509.subject")
+			}
+		}
+	}
+	certOpts.subject = subject.Value
+	assignIfSet(validity, &certOpts.validity)
+	assignIfSet(keyUsage, &certOpts.keyUsage)
+
+	if _, haveKid := props["kid"]; haveKid && count.Value > 1 {
+		return nil, errors.New("cannot set kid field with --count, each key must have a unique kid")
+	} else if haveKid && kid.IsSet {
+		return nil, errors.New("cannot use --kid when setting the kid field")
+	}
+	if !kid.IsSet {
+		// Set default to avoid bugs
+		var err error
+		if kid.Value, err = parseKidStrategy("thumbprint-sha256"); err != nil {
+			panic(err)
+		}
+	}
+
+	var generate func(rand io.Reader) (any, error)
+	// Only keys supported by crypto/x509 can sign a certificate
+	var canSelfSign bool
+	// The kind of key, for checking the consistency of its properties
+	var (
+		keyKty  jwa.KeyType
+		keyCrv  jwa.EllipticCurveAlgorithm
+		keyBits int
+	)
+
 	if rsabits.IsSet {
-		rawKey, err := rsa.GenerateKey(rand.Reader, rsabits.Value)
-		if err != nil {
-			return err
+		keyKty = jwa.RSA
+		canSelfSign = true
+		generate = func(rand io.Reader) (any, error) {
+			if deterministic.IsSet {
+				return generateRSADeterministic(rand, rsabits.Value)
+			}
+			return rsa.GenerateKey(rand, rsabits.Value)
 		}
-		return addKey(rawKey, props, set)
 	}
 
 	if ec.IsSet {
@@ -122,20 +378,25 @@ func handleGen(args []string, set jwk.Set) error {
 				crvval = jwa.P384.String()
 			case jwa.ES512.String():
 				crvval = jwa.P521.String()
+			case jwa.ES256K.String():
+				crvval = crvSecp256k1
 			default:
 				if _, ok := props["alg"]; ok {
-					return errors.New("cannot infer crv from alg field, must set crv field with --setstr or --setjson for --ec")
+					return nil, errors.New("cannot infer crv from alg field, must set crv field with --setstr or --setjson for --ec")
 				}
-				return errors.New("must set crv or alg field with --setstr or --setjson for --ec")
+				return nil, errors.New("must set crv or alg field with --setstr or --setjson for --ec")
 			}
 		}
 		crv, crvIsString := crvval.(string)
 		if !crvIsString {
-			return errors.New("crv field must be string for --ec")
+			return nil, errors.New("crv field must be string for --ec")
 		}
 		curve, haveCurve := jwk.CurveForAlgorithm(jwa.EllipticCurveAlgorithm(crv))
+		if !haveCurve && crv == crvSecp256k1 {
+			return nil, errors.New("curve unavailable, secp256k1 requires building with -tags jwx_es256k")
+		}
 		if !haveCurve {
-			return errors.New("curve unavailable")
+			return nil, errors.New("curve unavailable")
 		}
 		if _, haveAlg := props["alg"]; !haveAlg {
 			switch crv {
@@ -145,62 +406,453 @@ func handleGen(args []string, set jwk.Set) error {
 				props["alg"] = jwa.ES384.String()
 			case jwa.P521.String():
 				props["alg"] = jwa.ES512.String()
+			case crvSecp256k1:
+				props["alg"] = jwa.ES256K.String()
 			}
 		}
 
-		rawKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-		if err != nil {
-			return err
+		keyKty, keyCrv = jwa.EC, jwa.EllipticCurveAlgorithm(crv)
+		canSelfSign = crv != crvSecp256k1
+		generate = func(rand io.Reader) (any, error) {
+			if deterministic.IsSet {
+				return generateECDSADeterministic(rand, curve)
+			}
+			return ecdsa.GenerateKey(curve, rand)
 		}
-		return addKey(rawKey, props, set)
 	}
 
 	if okp.IsSet {
+		crvval, haveCrv := props["crv"]
+		if !haveCrv {
+			return nil, errors.New("must set crv field with --setstr or --setjson for --okp")
+		}
+		crv, crvIsStr := crvval.(string)
+		if !crvIsStr {
+			return nil, errors.New("crv field must be string for --okp")
+		}
+
 		algval, haveAlg := props["alg"]
 		if haveAlg {
 			alg, algIsStr := algval.(string)
 			if !algIsStr {
-				return errors.New("alg field must be string for --okp")
+				return nil, errors.New("alg field must be string for --okp")
 			}
-			if alg != jwa.EdDSA.String() {
-				return errors.New("invalid alg field value for --okp")
+			// Besides EdDSA, OKP keys on the X25519 and X448 curves are used with ECDH-ES
+			if spec, known := algSpecs[alg]; !known || !slices.Contains(spec.curves, jwa.EllipticCurveAlgorithm(crv)) {
+				return nil, errors.New("invalid alg field value for --okp")
 			}
+		} else if crv == jwa.X25519.String() || crv == jwa.X448.String() {
+			props["alg"] = jwa.ECDH_ES.String()
 		} else {
 			props["alg"] = jwa.EdDSA.String()
 		}
 
-		crvval, haveCrv := props["crv"]
-		if !haveCrv {
-			return errors.New("must set crv field with --setstr or --setjson for --okp")
-		}
-		crv, crvIsStr := crvval.(string)
-		if !crvIsStr {
-			return errors.New("crv field must be string for --okp")
-		}
-		var rawKey any
-		var err error
+		keyKty, keyCrv = jwa.OKP, jwa.EllipticCurveAlgorithm(crv)
 		switch crv {
 		case jwa.Ed25519.String():
-			_, rawKey, err = ed25519.GenerateKey(rand.Reader)
+			canSelfSign = true
+			generate = func(rand io.Reader) (any, error) {
+				_, rawKey, err := ed25519.GenerateKey(rand)
+				return rawKey, err
+			}
 		case jwa.X25519.String():
-			_, rawKey, err = x25519.GenerateKey(rand.Reader)
+			generate = func(rand io.Reader) (any, error) {
+				_, rawKey, err := x25519.GenerateKey(rand)
+				return rawKey, err
+			}
+		case jwa.Ed448.String(), jwa.X448.String():
+			generate = func(rand io.Reader) (any, error) {
+				return generateOKP448(jwa.EllipticCurveAlgorithm(crv), rand)
+			}
 		default:
-			return errors.New("curve unavailable")
+			return nil, errors.New("curve unavailable")
+		}
+	}
+
+	if oct.IsSet {
+		bits := oct.Value
+		if algval, haveAlg := props["alg"]; haveAlg {
+			alg, algIsStr := algval.(string)
+			if !algIsStr {
+				return nil, errors.New("alg field must be string for --oct")
+			}
+			algBits, exact, known := octBitsForAlg(alg)
+			switch {
+			case !known && bits == 0:
+				return nil, errors.New("cannot infer key size from alg field, must give a size with --oct")
+			case !known:
+			case bits == 0:
+				bits = algBits
+			case exact && bits != algBits, bits < algBits:
+				return nil, errors.New("bit-length for --oct does not match the alg field")
+			}
+		} else if bits == 0 {
+			return nil, errors.New("must give a size with --oct or set alg field with --setstr or --setjson")
 		}
+
+		keyKty, keyBits = jwa.OctetSeq, bits
+		if derive.IsSet {
+			derivation, err := prepareDerivation(derive.Value, deriveSalt, deriveInfo, deriveFile, deriveEnv)
+			if err != nil {
+				return nil, err
+			}
+			if _, haveParam := props[deriveParam]; haveParam {
+				return nil, errors.New("cannot set " + deriveParam + " field with --oct.derive")
+			}
+			props[deriveParam] = derivation.params()
+			generate = func(io.Reader) (any, error) {
+				return derivation.derive(bits / 8) //nolint:mnd // bits per byte
+			}
+		} else {
+			generate = func(rand io.Reader) (any, error) {
+				rawKey := make([]byte, bits/8) //nolint:mnd // bits per byte
+				if _, err := io.ReadFull(rand, rawKey); err != nil {
+					return nil, err
+				}
+				return rawKey, nil
+			}
+		}
+	}
+
+	if pqc.IsSet {
+		if algval, haveAlg := props["alg"]; haveAlg && algval != pqc.Value {
+			return nil, errors.New("alg field must match --pqc")
+		}
+		props["alg"] = pqc.Value
+		keyKty = ktyAKP
+		generate = func(rand io.Reader) (any, error) {
+			return generateAKP(pqc.Value, rand)
+		}
+	}
+
+	if generate == nil {
+		panic("unreachable")
+	}
+	keyAlg, keyUse, keyOps, err := keyProps(props)
+	if err != nil {
+		return nil, err
+	}
+	if !lax.IsSet {
+		if err = validateProps(keyKty, keyCrv, keyBits, keyAlg, keyUse, keyOps); err != nil {
+			return nil, fmt.Errorf("%w, use --lax to allow inconsistent properties", err)
+		}
+	}
+	sharedKid, isShared := props[jwk.KeyIDKey].(string)
+	if !isShared {
+		if sharedKid, isShared, err = kid.Value.shared(keyKty, keyCrv, keyAlg); err != nil {
+			return nil, err
+		}
+		if isShared && count.Value > 1 {
+			return nil, errors.New("--kid strategy gives every key the same kid, cannot use it with --count")
+		}
+	}
+	if isShared {
+		if kids[sharedKid] {
+			return nil, errors.New("kid " + sharedKid + " is already used by another key")
+		}
+		kids[sharedKid] = true
+	}
+	if subject.IsSet && !canSelfSign {
+		return nil, errors.New("--x509.subject requires an RSA, EC (other than secp256k1) or Ed25519 key")
+	}
+
+	newRand := func(int) io.Reader { return rand.Reader }
+	if deterministic.IsSet {
+		seed, err := os.ReadFile(seedFile.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) < minSeedSize {
+			return nil, errors.New("seed file must contain at least 32 bytes")
+		}
+		newRand = func(idx int) io.Reader {
+			// Each key gets its own generator, so the keys don't depend on the order in which they're generated
+			return newHMACDRBG(seed, []byte("jwknife gen "+strconv.Itoa(idx)))
+		}
+	}
+
+	return func(set jwk.Set) error {
+		rawKeys, err := generateConcurrently(count.Value, newRand, generate)
 		if err != nil {
 			return err
 		}
-		return addKey(rawKey, props, set)
+		keys := make([]jwk.Key, 0, len(rawKeys))
+		kids := make(map[string]bool, len(rawKeys))
+		for _, rawKey := range rawKeys {
+			var certDER []byte
+			if subject.IsSet {
+				if certDER, err = selfSign(rawKey, certOpts); err != nil {
+					return err
+				}
+			}
+			key, err := newKey(rawKey, props, certDER, kid.Value)
+			if err != nil {
+				return err
+			}
+			if kids[key.KeyID()] {
+				return errors.New("--kid strategy gave the same kid to more than one key")
+			}
+			kids[key.KeyID()] = true
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			if err = set.AddKey(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// defaultStampPrefix is the prefix of the properties recording the times of -stamp and -valid-for.
+const defaultStampPrefix = "x-jwknife-"
+
+// minSeedSize is the minimum size of a -seed.file, matching the security strength of the DRBG.
+const minSeedSize = 32
+
+// generateConcurrently calls generate count times, spreading the calls across the available CPUs. This mainly helps with large RSA keys, which are slow to generate.
+func generateConcurrently(count int, newRand func(idx int) io.Reader, generate func(rand io.Reader) (any, error)) ([]any, error) {
+	rawKeys := make([]any, count)
+	errs := make([]error, count)
+	limit := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for idx := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			rawKeys[idx], errs[idx] = generate(newRand(idx))
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return rawKeys, nil
+}
+
+func parsePQCAlg(s string) (string, error) {
+	if _, known := akpSchemes[s]; !known {
+		return "", errors.New("unsupported algorithm for --pqc")
 	}
+	return s, nil
+}
 
-	panic("unreachable")
+func parseGenAlg(s string) (string, error) {
+	if _, known := algSpecs[s]; !known {
+		return "", errors.New("unsupported algorithm for --alg")
+	}
+	return s, nil
 }
 
-func addKey(rawKey any, settings map[string]any, set jwk.Set) error {
-	key, err := jwk.FromRaw(rawKey)
+// keyMaterialParams are the JWK properties holding key material, across all key types.
+var keyMaterialParams = []string{"n", "e", "d", "p", "q", "dp", "dq", "qi", "oth", "x", "y", "k", "pub", "priv"}
+
+// applyLike copies the properties of the key with the given kid into props, except for its kid, key material, certificate and the properties in exclude, without overriding properties that are already set. Unless the kind of key is given by a flag in kinds, the flag for the same kind and size of key as the existing key is set.
+func applyLike(kid string, set jwk.Set, props map[string]any, kinds map[jwa.KeyType]flag, exclude []string) error {
+	key, found := set.LookupKeyID(kid)
+	if !found {
+		return errors.New("no key with kid " + kid + " for --like")
+	}
+
+	// Convert to untyped JSON, so the properties are the same as if given by -setjson
+	enc, err := json.Marshal(key)
+	if err != nil {
+		// this shouldn't be reachable as jwk.Keys should always be marshalable
+		panic(err)
+	}
+	var obj map[string]any
+	if err = json.Unmarshal(enc, &obj); err != nil {
+		// this shouldn't be reachable, as marshaling a jwk.Key should always produce a JSON object
+		panic(err)
+	}
+	for _, name := range append(slices.Clone(keyMaterialParams), deriveParam, jwk.KeyTypeKey, jwk.KeyIDKey, jwk.X509CertChainKey, jwk.X509CertThumbprintKey, jwk.X509CertThumbprintS256Key) {
+		delete(obj, name)
+	}
+	for _, name := range exclude {
+		delete(obj, name)
+	}
+	for name, value := range obj {
+		if _, exists := props[name]; !exists {
+			props[name] = value
+		}
+	}
+
+	for _, flag := range kinds {
+		if flag.IsSet() {
+			return nil
+		}
+	}
+	flag, supported := kinds[key.KeyType()]
+	if !supported {
+		return errors.New("unsupported key type for --like")
+	}
+	switch key.KeyType() {
+	case jwa.RSA:
+		//nolint:forcetypeassert // RSA keys always have a modulus
+		n := key.(interface{ N() []byte }).N()
+		return flag.SetValue(strconv.Itoa(8 * len(n))) //nolint:mnd // bits per byte
+	case jwa.OctetSeq:
+		//nolint:forcetypeassert // OCT keys are always jwk.SymmetricKeys
+		k := key.(jwk.SymmetricKey).Octets()
+		return flag.SetValue(strconv.Itoa(8 * len(k))) //nolint:mnd // bits per byte
+	case ktyAKP:
+		return flag.SetValue(key.Algorithm().String())
+	default:
+		// The curve of EC and OKP keys is given by the crv property
+		return flag.Set()
+	}
+}
+
+// applyAlgSpec sets the properties of the key from the algorithm, and selects the kind of key to generate by setting the corresponding flag in kinds. Properties or flags that conflict with the algorithm are rejected.
+func applyAlgSpec(alg string, props map[string]any, kinds map[jwa.KeyType]flag) error {
+	spec := algSpecs[alg]
+	if algval, haveAlg := props["alg"]; haveAlg && algval != alg {
+		return errors.New("alg field conflicts with --alg")
+	}
+	props["alg"] = alg
+
+	kty := spec.kty
+	if len(spec.curves) > 0 {
+		crv := spec.curves[0]
+		if crvval, haveCrv := props["crv"]; haveCrv {
+			crvstr, _ := crvval.(string)
+			if !slices.Contains(spec.curves, jwa.EllipticCurveAlgorithm(crvstr)) {
+				return errors.New("crv field conflicts with --alg")
+			}
+			crv = jwa.EllipticCurveAlgorithm(crvstr)
+		}
+		props["crv"] = crv.String()
+		kty = ktyForCurve(crv)
+	} else if _, haveCrv := props["crv"]; haveCrv {
+		return errors.New("crv field conflicts with --alg")
+	}
+
+	if useval, haveUse := props["use"]; haveUse && useval != string(spec.use) {
+		return errors.New("use field conflicts with --alg")
+	}
+	props["use"] = string(spec.use)
+
+	if opsval, haveOps := props["key_ops"]; haveOps {
+		ops, opsIsList := opsval.([]any)
+		if !opsIsList {
+			return errors.New("key_ops field must be a list")
+		}
+		for _, op := range ops {
+			if opstr, _ := op.(string); !slices.Contains(spec.ops, jwk.KeyOperation(opstr)) {
+				return errors.New("key_ops field conflicts with --alg")
+			}
+		}
+	} else {
+		props["key_ops"] = spec.ops
+	}
+
+	for flagKty, flag := range kinds {
+		if flagKty != kty && flag.IsSet() {
+			return errors.New("--" + flag.Name() + " conflicts with --alg")
+		}
+	}
+	flag := kinds[kty]
+	switch {
+	case flag.IsSet():
+		return nil
+	case kty == jwa.RSA:
+		return flag.SetValue(strconv.Itoa(spec.bits))
+	case kty == ktyAKP:
+		return flag.SetValue(alg)
+	default:
+		// The size of OCT keys is inferred from the alg field
+		return flag.Set()
+	}
+}
+
+// crvSecp256k1 is the name of the secp256k1 curve. The jwa.Secp256k1 constant is only defined when building with the jwx_es256k tag, which is also needed for jwx to support the curve.
+const crvSecp256k1 = "secp256k1"
+
+func parseOctBits(s string) (int, error) {
+	// Being conservative, allowing only the lengths used by the JWA algorithms
+	//nolint:mnd // no point in extracting these to constants
+	bits := map[string]int{
+		"128": 128,
+		"192": 192,
+		"256": 256,
+		"384": 384,
+		"512": 512,
+	}[s]
+	if bits == 0 {
+		return 0, errors.New("unsupported bit-length for --oct")
+	}
+	return bits, nil
+}
+
+// octBitsForAlg gives the size of OCT key used by the algorithm, and whether keys must be exactly that size rather than at least that size.
+//
+//nolint:mnd // no point in extracting these to constants
+func octBitsForAlg(alg string) (bits int, exact bool, known bool) {
+	switch alg {
+	case jwa.HS256.String():
+		return 256, false, true
+	case jwa.HS384.String():
+		return 384, false, true
+	case jwa.HS512.String():
+		return 512, false, true
+	case jwa.A128KW.String(), jwa.A128GCMKW.String(), jwa.A128GCM.String():
+		return 128, true, true
+	case jwa.A192KW.String(), jwa.A192GCMKW.String(), jwa.A192GCM.String():
+		return 192, true, true
+	case jwa.A256KW.String(), jwa.A256GCMKW.String(), jwa.A256GCM.String(), jwa.A128CBC_HS256.String():
+		return 256, true, true
+	case jwa.A192CBC_HS384.String():
+		return 384, true, true
+	case jwa.A256CBC_HS512.String():
+		return 512, true, true
+	default:
+		return 0, false, false
+	}
+}
+
+// setProp sets the property given by a name=value flag value, using load to get the property value from the value part.
+func setProp(props map[string]any, arg string, load func(value string) (any, error)) error {
+	name, value, found := strings.Cut(arg, "=")
+	if !found {
+		return errors.New("--set value must be key=value format")
+	}
+	if _, exists := props[name]; exists {
+		return errors.New("duplicate --set key")
+	}
+	loaded, err := load(value)
 	if err != nil {
 		return err
 	}
+	props[name] = loaded
+	return nil
+}
+
+func parseJSONProp(value string) (any, error) {
+	var obj any
+	if err := json.Unmarshal([]byte(value), &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// trimNewline removes a single trailing newline, as added by most editors and by echo.
+func trimNewline(value string) string {
+	value = strings.TrimSuffix(value, "\n")
+	return strings.TrimSuffix(value, "\r")
+}
+
+// newKey builds the JWK for a generated key, with the given properties, the certificate if given, and a kid assigned by the strategy.
+func newKey(rawKey any, settings map[string]any, certDER []byte, strategy kidStrategy) (jwk.Key, error) {
+	// Keys that jwx cannot build from a raw key, such as Ed448 keys, are passed in as a jwk.Key instead
+	key, isKey := rawKey.(jwk.Key)
+	if !isKey {
+		var err error
+		if key, err = jwk.FromRaw(rawKey); err != nil {
+			return nil, err
+		}
+	}
 
 	// Convert to untyped JSON so we can set arbitrary structured values from flags
 	enc, err := json.Marshal(key)
@@ -223,20 +875,25 @@ func addKey(rawKey any, settings map[string]any, set jwk.Set) error {
 	}
 
 	// Parse the new JSON, which incidentally gives us validation of the new properties by the jwk.Key.UnmarshalJSON method.
-	keyUpd, err := jwk.ParseKey(enc)
+	keyUpd, err := parseKey(enc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Write the properties back to the original key, possibly getting even more validation from the jwk.Key.Set method
 	for name := range settings {
 		value, _ := keyUpd.Get(name)
 		if err = key.Set(name, value); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if err = jwk.AssignKeyID(key); err != nil {
-		return err
+	if certDER != nil {
+		if err = setCertificate(key, certDER); err != nil {
+			return nil, err
+		}
+	}
+	if err = assignKeyID(key, strategy); err != nil {
+		return nil, err
 	}
-	return set.AddKey(key)
+	return key, nil
 }
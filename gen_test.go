@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestGenCount(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		count int
+	}{
+		{args: []string{"-rsa=2048"}, count: 4},
+		{args: []string{"-alg=ES256"}, count: 16},
+		{args: []string{"-okp", "-setstr=crv=Ed25519"}, count: 16},
+		{args: []string{"-oct=256"}, count: 16},
+	} {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			set := jwk.NewSet()
+			if err := handleGen(append(test.args, "-count="+strconv.Itoa(test.count)), set); err != nil {
+				t.Fatal(err)
+			}
+			if set.Len() != test.count {
+				t.Fatalf("got %d keys, expected %d", set.Len(), test.count)
+			}
+			kids := make(map[string]bool)
+			for idx := range set.Len() {
+				key, _ := set.Key(idx)
+				// The default kid is the thumbprint, so distinct kids mean distinct keys
+				if kids[key.KeyID()] {
+					t.Errorf("key %d has the same kid %s as an earlier key", idx, key.KeyID())
+				}
+				kids[key.KeyID()] = true
+
+				var rawKey any
+				if err := key.Raw(&rawKey); err != nil {
+					t.Fatal(err)
+				}
+				switch rawKey := rawKey.(type) {
+				case *rsa.PrivateKey:
+					if err := rawKey.Validate(); err != nil {
+						t.Errorf("key %d is invalid: %v", idx, err)
+					}
+				case *ecdsa.PrivateKey:
+					if _, err := rawKey.ECDH(); err != nil {
+						t.Errorf("key %d is invalid: %v", idx, err)
+					}
+				case ed25519.PrivateKey:
+					if len(rawKey) != ed25519.PrivateKeySize {
+						t.Errorf("key %d has %d bytes, expected %d", idx, len(rawKey), ed25519.PrivateKeySize)
+					}
+				case []byte:
+					if len(rawKey) != 32 {
+						t.Errorf("key %d has %d bytes, expected 32", idx, len(rawKey))
+					}
+				default:
+					t.Errorf("key %d is a %T, expected a private key", idx, rawKey)
+				}
+			}
+		})
+	}
+}
+
+func TestGenCertificateProps(t *testing.T) {
+	for _, name := range []string{"x5c", "x5t", "x5t#S256"} {
+		t.Run(name, func(t *testing.T) {
+			err := handleGen([]string{"-alg=ES256", "-x509.subject=CN=test", `-setjson=` + name + `=["AAAA"]`}, jwk.NewSet())
+			if err == nil || err.Error() != "cannot set "+name+" field with --x509.subject" {
+				t.Errorf("got error %v, expected the %s field to be rejected", err, name)
+			}
+		})
+	}
+
+	set := jwk.NewSet()
+	if err := handleGen([]string{"-alg=ES256", "-x509.subject=CN=test"}, set); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := set.Key(0)
+	if key.X509CertChain().Len() != 1 || key.X509CertThumbprint() == "" || key.X509CertThumbprintS256() == "" {
+		t.Error("expected the key to have the certificate properties")
+	}
+}
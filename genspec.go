@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"gopkg.in/yaml.v3"
+)
+
+// genSpecFile is the document read by gen -spec. YAML is a superset of JSON, so both are read by the YAML decoder.
+type genSpecFile struct {
+	Keys []genSpec `yaml:"keys"`
+}
+
+// genSpec describes keys to generate, and is translated into the equivalent gen flags so that it goes through the same validation.
+type genSpec struct {
+	Kty   string         `yaml:"kty"`
+	Size  *int           `yaml:"size"`
+	Crv   string         `yaml:"crv"`
+	Alg   string         `yaml:"alg"`
+	Use   string         `yaml:"use"`
+	Kid   string         `yaml:"kid"`
+	Count *int           `yaml:"count"`
+	Props map[string]any `yaml:"props"`
+}
+
+// prepareGenSpec reads the spec file and validates every entry, returning a function that generates the keys of all entries into a set. The kids are as for prepareGen.
+func prepareGenSpec(path string, set jwk.Set, kids map[string]bool) (func(set jwk.Set) error, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file genSpecFile
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	if len(file.Keys) == 0 {
+		return nil, errors.New("spec file must list at least one key")
+	}
+
+	generators := make([]func(set jwk.Set) error, 0, len(file.Keys))
+	for i, spec := range file.Keys {
+		args, err := spec.args()
+		if err != nil {
+			return nil, fmt.Errorf("spec key %d: %w", i+1, err)
+		}
+		generate, err := prepareGen(args, set, kids)
+		if err != nil {
+			return nil, fmt.Errorf("spec key %d: %w", i+1, err)
+		}
+		generators = append(generators, generate)
+	}
+	return func(set jwk.Set) error {
+		for i, generate := range generators {
+			if err := generate(set); err != nil {
+				return fmt.Errorf("spec key %d: %w", i+1, err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// args gives the gen flags for the spec.
+func (s genSpec) args() ([]string, error) {
+	var args []string
+	if s.Size != nil && s.Kty != jwa.RSA.String() && s.Kty != jwa.OctetSeq.String() {
+		return nil, errors.New("size is only supported for RSA and oct keys")
+	}
+	if s.Size != nil && *s.Size < 1 {
+		return nil, errors.New("size must be at least 1")
+	}
+	if s.Count != nil && *s.Count < 1 {
+		return nil, errors.New("count must be at least 1")
+	}
+	switch s.Kty {
+	case "":
+		if s.Alg == "" {
+			return nil, errors.New("must give kty or alg")
+		}
+	case jwa.RSA.String():
+		if s.Size == nil && s.Alg == "" {
+			return nil, errors.New("must give size or alg for RSA keys")
+		}
+		if s.Size != nil {
+			args = append(args, "-rsa="+strconv.Itoa(*s.Size))
+		}
+	case jwa.EC.String():
+		args = append(args, "-ec")
+	case jwa.OKP.String():
+		args = append(args, "-okp")
+	case jwa.OctetSeq.String():
+		if s.Size != nil {
+			args = append(args, "-oct="+strconv.Itoa(*s.Size))
+		} else {
+			args = append(args, "-oct")
+		}
+	case ktyAKP.String():
+		if s.Alg == "" {
+			return nil, errors.New("must give alg for AKP keys")
+		}
+		args = append(args, "-pqc="+s.Alg)
+	default:
+		return nil, errors.New("unsupported kty " + s.Kty)
+	}
+
+	if s.Alg != "" {
+		args = append(args, "-alg="+s.Alg)
+	}
+	if s.Crv != "" {
+		args = append(args, "-setstr=crv="+s.Crv)
+	}
+	if s.Use != "" {
+		args = append(args, "-setstr=use="+s.Use)
+	}
+	if s.Kid != "" {
+		args = append(args, "-kid="+s.Kid)
+	}
+	if s.Count != nil {
+		args = append(args, "-count="+strconv.Itoa(*s.Count))
+	}
+	names := make([]string, 0, len(s.Props))
+	for name := range s.Props {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value, err := json.Marshal(s.Props[name])
+		if err != nil {
+			return nil, fmt.Errorf("props %s: %w", name, err)
+		}
+		args = append(args, "-setjson="+name+"="+string(value))
+	}
+	return args, nil
+}
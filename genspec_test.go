@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestGenSpec(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		spec     string
+		wantKeys int
+		wantErr  string
+	}{
+		{name: "count omitted", spec: `{keys: [{alg: ES256}]}`, wantKeys: 1},
+		{name: "count", spec: `{keys: [{alg: ES256, count: 3}, {kty: oct, size: 256}]}`, wantKeys: 4},
+		{name: "count zero", spec: `{keys: [{alg: ES256}, {alg: ES256, count: 0}]}`, wantErr: "spec key 2: count must be at least 1"},
+		{name: "count negative", spec: `{keys: [{alg: ES256, count: -1}]}`, wantErr: "spec key 1: count must be at least 1"},
+		{name: "size zero", spec: `{keys: [{kty: oct, size: 0}]}`, wantErr: "spec key 1: size must be at least 1"},
+		{name: "rsa size zero", spec: `{keys: [{kty: RSA, size: 0, alg: RS256}]}`, wantErr: "spec key 1: size must be at least 1"},
+		{name: "size for ec", spec: `{keys: [{kty: EC, size: 0, alg: ES256}]}`, wantErr: "spec key 1: size is only supported for RSA and oct keys"},
+		{name: "rsa without size", spec: `{keys: [{kty: RSA}]}`, wantErr: "spec key 1: must give size or alg for RSA keys"},
+		{name: "duplicate fixed kid", spec: `{keys: [{alg: ES256, props: {kid: a}}, {alg: HS256, props: {kid: a}}]}`, wantErr: "spec key 2: kid a is already used by another key"},
+		{name: "shared kid with count", spec: `{keys: [{alg: ES256, kid: timestamp, count: 2}]}`, wantErr: "spec key 1: --kid strategy gives every key the same kid, cannot use it with --count"},
+		{name: "same template kid", spec: `{keys: [{alg: ES256, kid: "template:{{.alg}}"}, {alg: ES256, kid: "template:{{.alg}}"}]}`, wantErr: "spec key 2: kid ES256 is already used by another key"},
+		{name: "different template kids", spec: `{keys: [{alg: ES256, kid: "template:{{.alg}}"}, {alg: ES384, kid: "template:{{.alg}}"}]}`, wantKeys: 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "spec.yaml")
+			if err := os.WriteFile(path, []byte(test.spec), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			set := jwk.NewSet()
+			err := handleGen([]string{"-spec=" + path}, set)
+			switch {
+			case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+				t.Errorf("got error %v, expected %q", err, test.wantErr)
+			case test.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case set.Len() != test.wantKeys:
+				t.Errorf("got %d keys, expected %d", set.Len(), test.wantKeys)
+			}
+		})
+	}
+}
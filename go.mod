@@ -2,7 +2,12 @@ module github.com/devnev/jwknife
 
 go 1.22.3
 
-require github.com/lestrrat-go/jwx/v2 v2.1.1
+require (
+	github.com/cloudflare/circl v1.6.1
+	github.com/lestrrat-go/jwx/v2 v2.1.1
+	golang.org/x/crypto v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
@@ -13,6 +18,5 @@ require (
 	github.com/lestrrat-go/iter v1.0.2 // indirect
 	github.com/lestrrat-go/option v1.0.1 // indirect
 	github.com/segmentio/asm v1.2.0 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
 )
@@ -20,6 +20,12 @@ JWKnife: Manipulate & Convert JWK sets.
 Example:
 	{{.Command}} read -pem -path=my.pem gen -rsa=2048 -set=alg=RS256 -set=use=sig write -jwks -path=my-jwk.json
 
+Usage:
+	{{.Command}} {{.OptsSyntax}}
+
+Options:
+{{.OptsFlags | indent "\t"}}
+
 Available subcommands:
 {{.ReadSyntax | wrap 92 "     " | indent "\t"}}
 {{.GenSyntax | wrap 92 "    " | indent "\t"}}
@@ -57,6 +63,8 @@ func usage() string {
 	var buf bytes.Buffer
 	err := usageTpl.Execute(&buf, map[string]any{
 		"Command":      filepath.Base(os.Args[0]),
+		"OptsSyntax":   optsSyntax,
+		"OptsFlags":    optsFlags,
 		"ReadSyntax":   readSyntax,
 		"ReadSummary":  readSummary,
 		"ReadFlags":    readFlags,
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha1" // Registers the hash for thumbprint-sha1
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// kidStrategy produces the key ID for a key without one.
+type kidStrategy struct {
+	kid func(key jwk.Key) (string, error)
+	// shared gives the kid that the strategy assigns to every key of the given kind, if the kid doesn't depend on the key itself, so that duplicates can be found before generating keys
+	shared func(kty jwa.KeyType, crv jwa.EllipticCurveAlgorithm, alg string) (string, bool, error)
+}
+
+// kidThumbprintLength is the length of the truncated thumbprint available to kid templates.
+const kidThumbprintLength = 8
+
+// crockford is the base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// notShared is the kidStrategy.shared function of strategies that give each key its own kid.
+func notShared(jwa.KeyType, jwa.EllipticCurveAlgorithm, string) (string, bool, error) {
+	return "", false, nil
+}
+
+func parseKidStrategy(value string) (kidStrategy, error) {
+	// Time-based key IDs use the time of the command, so that all keys of the command are consistent
+	now := time.Now().UTC()
+
+	if text, isTemplate := strings.CutPrefix(value, "template:"); isTemplate {
+		tpl, err := template.New("kid").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return kidStrategy{}, err
+		}
+		execute := func(kty, crv, alg, thumbprint string) (string, error) {
+			data := map[string]string{
+				"alg":        alg,
+				"kty":        kty,
+				"crv":        crv,
+				"date":       now.Format(time.DateOnly),
+				"thumbprint": thumbprint,
+			}
+			var kid strings.Builder
+			if err := tpl.Execute(&kid, data); err != nil {
+				return "", err
+			}
+			if kid.Len() == 0 {
+				return "", errors.New("kid template produced an empty kid")
+			}
+			return kid.String(), nil
+		}
+		return kidStrategy{
+			kid: func(key jwk.Key) (string, error) {
+				thumbprint, err := thumbprintKid(key, crypto.SHA256)
+				if err != nil {
+					return "", err
+				}
+				var alg, crv string
+				if value, ok := key.Get(jwk.AlgorithmKey); ok {
+					alg = value.(interface{ String() string }).String() //nolint:forcetypeassert // alg is always a jwa.KeyAlgorithm
+				}
+				if value, ok := key.Get("crv"); ok {
+					crv = value.(interface{ String() string }).String() //nolint:forcetypeassert // crv is always a jwa.EllipticCurveAlgorithm
+				}
+				return execute(key.KeyType().String(), crv, alg, thumbprint[:kidThumbprintLength])
+			},
+			shared: func(kty jwa.KeyType, crv jwa.EllipticCurveAlgorithm, alg string) (string, bool, error) {
+				// Only the thumbprint differs between keys of the same kind, so the kid is shared if two different thumbprints give the same kid
+				kid, err := execute(kty.String(), crv.String(), alg, strings.Repeat("A", kidThumbprintLength))
+				if err != nil {
+					return "", false, err
+				}
+				other, err := execute(kty.String(), crv.String(), alg, strings.Repeat("B", kidThumbprintLength))
+				if err != nil {
+					return "", false, err
+				}
+				return kid, kid == other, nil
+			},
+		}, nil
+	}
+
+	switch value {
+	case "thumbprint-sha256":
+		return kidStrategy{
+			kid: func(key jwk.Key) (string, error) {
+				return thumbprintKid(key, crypto.SHA256)
+			},
+			shared: notShared,
+		}, nil
+	case "thumbprint-sha1":
+		return kidStrategy{
+			kid: func(key jwk.Key) (string, error) {
+				return thumbprintKid(key, crypto.SHA1)
+			},
+			shared: notShared,
+		}, nil
+	case "uuid":
+		return kidStrategy{
+			kid: func(jwk.Key) (string, error) {
+				var uuid [16]byte
+				if _, err := rand.Read(uuid[:]); err != nil {
+					return "", err
+				}
+				// Set the version 4 and the RFC 4122 variant bits
+				uuid[6] = (uuid[6] & 0x0f) | 0x40
+				uuid[8] = (uuid[8] & 0x3f) | 0x80
+				enc := hex.EncodeToString(uuid[:])
+				return enc[:8] + "-" + enc[8:12] + "-" + enc[12:16] + "-" + enc[16:20] + "-" + enc[20:], nil
+			},
+			shared: notShared,
+		}, nil
+	case "ulid":
+		return kidStrategy{
+			kid: func(jwk.Key) (string, error) {
+				// A ULID is a 48-bit millisecond timestamp followed by 80 random bits
+				var ulid [16]byte
+				binary.BigEndian.PutUint64(ulid[:8], uint64(now.UnixMilli())<<16) //nolint:gosec,mnd // the timestamp is positive; the top 48 bits of the 64
+				if _, err := rand.Read(ulid[6:]); err != nil {
+					return "", err
+				}
+				// The 128 bits are encoded as 26 characters, the first of which only encodes the top 3 bits
+				n := new(big.Int).SetBytes(ulid[:])
+				digit := big.NewInt(0)
+				var enc [26]byte
+				for i := len(enc) - 1; i >= 0; i-- {
+					n.DivMod(n, big.NewInt(int64(len(crockford))), digit)
+					enc[i] = crockford[digit.Int64()]
+				}
+				return string(enc[:]), nil
+			},
+			shared: notShared,
+		}, nil
+	case "timestamp":
+		timestamp := now.Format("20060102T150405Z")
+		return kidStrategy{
+			kid: func(jwk.Key) (string, error) {
+				return timestamp, nil
+			},
+			shared: func(jwa.KeyType, jwa.EllipticCurveAlgorithm, string) (string, bool, error) {
+				return timestamp, true, nil
+			},
+		}, nil
+	default:
+		return kidStrategy{}, errors.New("unsupported key ID strategy")
+	}
+}
+
+func thumbprintKid(key jwk.Key, hash crypto.Hash) (string, error) {
+	thumbprint, err := key.Thumbprint(hash)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// assignKeyID sets the kid of the key using the strategy, unless the key already has a kid.
+func assignKeyID(key jwk.Key, strategy kidStrategy) error {
+	if _, haveKid := key.Get(jwk.KeyIDKey); haveKid {
+		return nil
+	}
+	kid, err := strategy.kid(key)
+	if err != nil {
+		return err
+	}
+	return key.Set(jwk.KeyIDKey, kid)
+}
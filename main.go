@@ -67,9 +67,46 @@ func run(args []string) error {
 	return nil
 }
 
+var optsSyntax = strings.TrimSpace(`
+[-verbose] command...
+`)
+
+var optsFlags = strings.TrimSpace(`
+-verbose Report progress, such as the proxy used for each request, on stderr.
+`)
+
+// verbose is set by the -verbose option, and enables the output of logVerbose.
+var verbose bool
+
 func handleOpts(args []string) error {
-	if len(args) > 0 {
-		return errors.New("invalid option")
+	var (
+		optflags   = flagset{}
+		verboseOpt = addNoValueFlag(optflags, "verbose")
+	)
+
+	for _, arg := range args {
+		name, value, found := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		flag := optflags[name]
+		var err error
+		switch {
+		case flag == nil:
+			err = errors.New("invalid option --" + name)
+		case !found:
+			err = flag.Set()
+		default:
+			err = flag.SetValue(value)
+		}
+		if err != nil {
+			return err
+		}
 	}
+
+	verbose = verboseOpt.IsSet
 	return nil
 }
+
+func logVerbose(format string, args ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
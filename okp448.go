@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x448"
+	"github.com/cloudflare/circl/sign/ed448"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// jwx parses and serialises Ed448 and X448 keys in JWK form, but cannot convert them to or from raw keys. Generation and PEM encoding of these keys is done here instead, using circl for the curve operations.
+
+// OIDs from RFC 8410.
+var (
+	oidX448  = asn1.ObjectIdentifier{1, 3, 101, 111}
+	oidEd448 = asn1.ObjectIdentifier{1, 3, 101, 113}
+)
+
+// pkcs8 is the PKCS #8 private key structure, as used by RFC 8410.
+type pkcs8 struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// pkixPublicKey is the SubjectPublicKeyInfo structure, as used by RFC 8410.
+type pkixPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// okp448Curve returns the curve of an Ed448 or X448 key, or false for any other key.
+func okp448Curve(key jwk.Key) (jwa.EllipticCurveAlgorithm, bool) {
+	okpKey, isOKP := key.(interface {
+		Crv() jwa.EllipticCurveAlgorithm
+	})
+	if !isOKP || key.KeyType() != jwa.OKP {
+		return "", false
+	}
+	switch crv := okpKey.Crv(); crv {
+	case jwa.Ed448, jwa.X448:
+		return crv, true
+	default:
+		return "", false
+	}
+}
+
+func generateOKP448(crv jwa.EllipticCurveAlgorithm, rand io.Reader) (jwk.Key, error) {
+	var size int
+	switch crv {
+	case jwa.Ed448:
+		size = ed448.SeedSize
+	case jwa.X448:
+		size = x448.Size
+	default:
+		return nil, errors.New("curve unavailable")
+	}
+	d := make([]byte, size)
+	if _, err := io.ReadFull(rand, d); err != nil {
+		return nil, err
+	}
+	return newOKP448Key(crv, nil, d)
+}
+
+// newOKP448Key builds a JWK from the raw public key x, or private key d. When d is given, x is derived from it, and must match if also given.
+func newOKP448Key(crv jwa.EllipticCurveAlgorithm, x []byte, d []byte) (jwk.Key, error) {
+	if d != nil {
+		var derived []byte
+		switch crv {
+		case jwa.Ed448:
+			if len(d) != ed448.SeedSize {
+				return nil, errors.New("invalid Ed448 private key size")
+			}
+			//nolint:forcetypeassert // the public key of an ed448.PrivateKey is always an ed448.PublicKey
+			derived = ed448.NewKeyFromSeed(d).Public().(ed448.PublicKey)
+		case jwa.X448:
+			if len(d) != x448.Size {
+				return nil, errors.New("invalid X448 private key size")
+			}
+			var public, secret x448.Key
+			copy(secret[:], d)
+			x448.KeyGen(&public, &secret)
+			derived = public[:]
+		default:
+			return nil, errors.New("curve unavailable")
+		}
+		if x != nil && !bytes.Equal(x, derived) {
+			return nil, errors.New("public key does not match private key")
+		}
+		x = derived
+	} else if (crv == jwa.Ed448 && len(x) != ed448.PublicKeySize) || (crv == jwa.X448 && len(x) != x448.Size) {
+		return nil, errors.New("invalid public key size")
+	}
+
+	obj := map[string]string{
+		"kty": jwa.OKP.String(),
+		"crv": crv.String(),
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+	}
+	if d != nil {
+		obj["d"] = base64.RawURLEncoding.EncodeToString(d)
+	}
+	enc, err := json.Marshal(obj)
+	if err != nil {
+		// this shouldn't be reachable, as a map of strings is always marshalable
+		panic(err)
+	}
+	return jwk.ParseKey(enc)
+}
+
+// encodeOKP448PEM encodes an Ed448 or X448 key as a PKCS #8 private key or a PKIX public key.
+func encodeOKP448PEM(key jwk.Key, crv jwa.EllipticCurveAlgorithm) ([]byte, error) {
+	algorithm := pkix.AlgorithmIdentifier{Algorithm: oidEd448}
+	if crv == jwa.X448 {
+		algorithm.Algorithm = oidX448
+	}
+
+	if privKey, isPriv := key.(jwk.OKPPrivateKey); isPriv {
+		curvePrivateKey, err := asn1.Marshal(privKey.D())
+		if err != nil {
+			return nil, err
+		}
+		der, err := asn1.Marshal(pkcs8{Algorithm: algorithm, PrivateKey: curvePrivateKey})
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+
+	pubKey, isPub := key.(jwk.OKPPublicKey)
+	if !isPub {
+		return nil, errors.New("unsupported key type")
+	}
+	der, err := asn1.Marshal(pkixPublicKey{
+		Algorithm: algorithm,
+		PublicKey: asn1.BitString{Bytes: pubKey.X(), BitLength: 8 * len(pubKey.X())}, //nolint:mnd // bits per byte
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// decodeOKP448PEM decodes a PKCS #8 private key or PKIX public key block, returning false if the block does not contain an Ed448 or X448 key.
+func decodeOKP448PEM(block *pem.Block) (jwk.Key, bool, error) {
+	curveFor := func(algorithm pkix.AlgorithmIdentifier) (jwa.EllipticCurveAlgorithm, bool) {
+		switch {
+		case algorithm.Algorithm.Equal(oidEd448):
+			return jwa.Ed448, true
+		case algorithm.Algorithm.Equal(oidX448):
+			return jwa.X448, true
+		default:
+			return "", false
+		}
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		var privKey pkcs8
+		if _, err := asn1.Unmarshal(block.Bytes, &privKey); err != nil {
+			// Leave it to jwx to report errors for other kinds of keys
+			return nil, false, nil //nolint:nilerr // see above
+		}
+		crv, is448 := curveFor(privKey.Algorithm)
+		if !is448 {
+			return nil, false, nil
+		}
+		var d []byte
+		if rest, err := asn1.Unmarshal(privKey.PrivateKey, &d); err != nil {
+			return nil, true, err
+		} else if len(rest) != 0 {
+			return nil, true, errors.New("trailing data after private key")
+		}
+		key, err := newOKP448Key(crv, nil, d)
+		return key, true, err
+	case "PUBLIC KEY":
+		var pubKey pkixPublicKey
+		if _, err := asn1.Unmarshal(block.Bytes, &pubKey); err != nil {
+			return nil, false, nil //nolint:nilerr // see above
+		}
+		crv, is448 := curveFor(pubKey.Algorithm)
+		if !is448 {
+			return nil, false, nil
+		}
+		key, err := newOKP448Key(crv, pubKey.PublicKey.RightAlign(), nil)
+		return key, true, err
+	default:
+		return nil, false, nil
+	}
+}
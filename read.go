@@ -3,8 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	neturl "net/url"
 	"os"
@@ -16,23 +19,46 @@ import (
 )
 
 var readSyntax = strings.TrimSpace(`
-read [-jwks] [-pem] [-path=path] [-url=url] [-url.allow-plaintext] [-url.schemes=scheme[,...]] [-url.timeout=duration] [-url.retry.interval=duration] [-url.retry.backoff=float] [-url.retry.end=duration] [-url.retry.jitter=float]
+read [-jwks] [-pem] [-optional] [-annotate=name=value] [-annotate.source] [-kid=strategy] [-decrypt.password.file=path] [-path=path] [-url=url] [-url.strategy=ordered|race] [-url.allow-plaintext] [-url.proxy=url|none] [-url.schemes=scheme[,...]] [-url.timeout=duration] [-url.retry.interval=duration] [-url.retry.backoff=float] [-url.retry.end=duration] [-url.retry.jitter=float]
 `)
 
 var readSummary = strings.TrimSpace(`
 Append keys to the JWK set.
 
-The source may be given using a path or a URL. The supported URL schemes are file, http and https, but http is only enabled when the -allow-plaintext flag is set. To further restrict the allowed schemes, use the --scheme flag.
+The source may be given using a path or a URL. The supported URL schemes are file, http and https, but http is only enabled when the -allow-plaintext flag is set. To further restrict the allowed schemes, use the --scheme flag. HTTP(S) requests use the proxy given by the environment unless -url.proxy is given; a proxy with the http scheme also requires -url.allow-plaintext.
 
-If -pem is given, the ssource must be a series of one or more PEM blocks. Otherwise (with -jwks given, or neither -jwks nor -pem), the source must be either a JWK or a JWK set.
+Multiple paths or multiple URLs may be given as mirrors of the same source. The keys from the first mirror to be read and parsed successfully are added to the set, and the read fails only if every mirror fails. The mirrors, whether paths or URLs, are tried in turn, or read concurrently if -url.strategy=race is given. The retry settings apply to each mirror individually.
+
+If -optional is given, a source that does not exist is skipped instead of failing the read. A source does not exist if the file is missing or a HTTP(S) request returns a 404 status, which is not retried. Other errors, such as parse errors, permission errors or other HTTP(S) failures, still fail the read.
+
+To keep track of where keys came from, -annotate and -annotate.source set properties on each key that is read. Use write -strip to remove them again before publishing the keys. Keys read without a "kid" property can be given one using -kid, with the same strategies as for the gen command; existing key IDs are left unchanged.
+
+If -pem is given, the ssource must be a series of one or more PEM blocks. Otherwise (with -jwks given, or neither -jwks nor -pem), the source must be either a JWK or a JWK set. Post-quantum keys of the draft AKP key type are supported in JWKs.
+
+If -decrypt.password.file is given, the source must be a JWK or JWK set encrypted as a JWE in compact serialization using PBES2-HS512+A256KW with the password read from the file, such as written by write -encrypt.password.file. The password file's contents are used without a single trailing newline. The JWE's "cty" header must be "jwk-set+json" or "jwk+json".
 `)
 
 var readFlags = strings.TrimSpace(`
 -jwks                        The source must be a JWK or JWK set.
 -pem                         The source must be a series of PEM blocks.
--path=path                   The path of the source file.
--url=url                     The url of the source. Supported schemes are file, http and https.
+-optional                    Add no keys instead of failing if the source does not exist.
+-annotate=name=value         Set the property to the string value on each key read. May be
+                             repeated.
+-annotate.source             Set the "x-jwknife-source" property of each key read to the path or
+                             URL it was read from.
+-kid=strategy                Set the "kid" property of each key read that has none, using the given
+                             strategy as for gen -kid.
+-decrypt.password.file=path  Decrypt the source, a password-encrypted JWE, using the password in
+                             the file.
+-path=path                   The path of the source file. May be repeated to give fallback mirrors.
+-url=url                     The url of the source. Supported schemes are file, http and https. May
+                             be repeated to give fallback mirrors.
+-url.strategy=ordered|race   How to read from multiple mirrors. With ordered, each mirror is tried
+                             in turn. With race, all mirrors are read concurrently. Also applies
+                             to -path mirrors. Default is ordered.
 -url.allow-plaintext         Allow plaintext traffic during retrieval of the URL.
+-url.proxy=url|none          The proxy to use for HTTP(S) requests, or none to disable proxying.
+                             Defaults to the proxy given by the environment.
 -url.schemes=scheme[,...]    The schemes to allow. Defaults to all supported if not specified.
 -url.timeout=duration        Timeout for a remote read. Default is 10s.
 -url.retry.interval=duration Interval after a failed remote read before retrying. Default is 1s.
@@ -52,8 +78,10 @@ func handleRead(args []string, set jwk.Set) error {
 		readflags = flagset{}
 		jwks      = addNoValueFlag(readflags, "jwks")
 		pem       = addNoValueFlag(readflags, "pem")
-		path      = addUnparsedFlag(readflags, "path")
-		url       = addValueFlag[*neturl.URL](readflags, "url", neturl.Parse)
+		optional  = addNoValueFlag(readflags, "optional")
+		path      = addUnparsedSliceFlag(readflags, "path")
+		url       = addSliceFlag[*neturl.URL](readflags, "url", neturl.Parse)
+		strategy  = addValueFlag[mirrorStrategy](readflags, "url.strategy", parseMirrorStrategy)
 		schemes   = addValueFlag[[]string](readflags, "url.schemes", func(v string) ([]string, error) {
 			split := strings.Split(v, ",")
 			for _, scheme := range split {
@@ -64,11 +92,28 @@ func handleRead(args []string, set jwk.Set) error {
 			return split, nil
 		})
 		plaintext = addNoValueFlag(readflags, "url.allow-plaintext")
+		proxy     = addValueFlag[*neturl.URL](readflags, "url.proxy", parseProxyURL)
 		timeout   = addValueFlag[time.Duration](readflags, "url.timeout", parseNonNegativeDuration)
 		interval  = addValueFlag[time.Duration](readflags, "url.retry.interval", parseNonNegativeDuration)
 		backoff   = addValueFlag[float64](readflags, "url.retry.backoff", parseMultiplier)
 		retryEnd  = addValueFlag[time.Duration](readflags, "url.retry.end", parseNonNegativeDuration)
 		jitter    = addValueFlag[float64](readflags, "url.retry.jitter", parseNonNegativeFloat)
+
+		annotations = make(map[string]any)
+		_           = addExternalFlag(readflags, "annotate", func(value string) error {
+			name, value, found := strings.Cut(value, "=")
+			if !found {
+				return errors.New("--annotate value must be name=value format")
+			}
+			if _, exists := annotations[name]; exists {
+				return errors.New("duplicate --annotate name")
+			}
+			annotations[name] = value
+			return nil
+		})
+		annotateSource = addNoValueFlag(readflags, "annotate.source")
+		kid            = addValueFlag[kidStrategy](readflags, "kid", parseKidStrategy)
+		decrypt        = addUnparsedFlag(readflags, "decrypt.password.file")
 	)
 
 	for _, arg := range args {
@@ -98,7 +143,8 @@ func handleRead(args []string, set jwk.Set) error {
 		return err
 	}
 	for name, flag := range readflags {
-		if strings.HasPrefix(name, "url.") {
+		// The mirror strategy also applies to path mirrors
+		if strings.HasPrefix(name, "url.") && name != "url.strategy" {
 			if err := oneOf(true, path.Iface(), flag); err != nil {
 				return err
 			}
@@ -111,6 +157,9 @@ func handleRead(args []string, set jwk.Set) error {
 			}
 		}
 	}
+	if err := checkProxyURL(proxy.Value, plaintext.IsSet); err != nil {
+		return err
+	}
 	if !schemes.IsSet {
 		if plaintext.IsSet {
 			schemes.Value = supportedSchemes
@@ -119,9 +168,31 @@ func handleRead(args []string, set jwk.Set) error {
 		}
 	}
 
+	if _, exists := annotations[sourceAnnotation]; exists && annotateSource.IsSet {
+		return errors.New("cannot specify both --annotate.source and --annotate=" + sourceAnnotation + "=...")
+	}
+
+	var kind = kindJWK
+	if pem.IsSet {
+		kind = kindPEM
+	}
+	var password []byte
+	if decrypt.IsSet {
+		if pem.IsSet {
+			return errors.New("cannot specify both --pem and --decrypt.password.file")
+		}
+		var err error
+		if password, err = readPasswordFile(decrypt.Value); err != nil {
+			return err
+		}
+	}
+
+	var mirrors []mirror
 	if url.IsSet {
-		if !slices.Contains(schemes.Value, url.Value.Scheme) {
-			return errors.New("blocked url scheme")
+		for _, from := range url.Value {
+			if !slices.Contains(schemes.Value, from.Scheme) {
+				return errors.New("blocked url scheme")
+			}
 		}
 
 		reqConf := defaultHTTPConf
@@ -130,46 +201,181 @@ func handleRead(args []string, set jwk.Set) error {
 		assignIfSet(backoff, &reqConf.backoff)
 		assignIfSet(retryEnd, &reqConf.retryFor)
 		assignIfSet(jitter, &reqConf.jitter)
-
-		var kind = kindJWK
-		if pem.IsSet {
-			kind = kindPEM
+		if proxy.IsSet {
+			reqConf.proxy = http.ProxyURL(proxy.Value)
 		}
 
-		return readFromURL(url.Value, reqConf, kind, set)
+		for _, from := range url.Value {
+			mirrors = append(mirrors, mirror{
+				name: from.Redacted(),
+				read: func(ctx context.Context, set jwk.Set) error {
+					// Each mirror gets its own copy of the config, and so its own retry budget
+					return readFromURL(ctx, from, reqConf, kind, password, optional.IsSet, set)
+				},
+			})
+		}
 	}
 
 	if path.IsSet {
-		var kind = kindJWK
-		if pem.IsSet {
-			kind = kindPEM
+		for _, from := range path.Value {
+			mirrors = append(mirrors, mirror{
+				name: from,
+				read: func(_ context.Context, set jwk.Set) error {
+					return readFromPath(from, kind, password, set)
+				},
+			})
+		}
+	}
+
+	race := strategy.Value == strategyRace
+	read, source, err := readFromMirrors(mirrors, race, optional.IsSet)
+	if err != nil {
+		return err
+	}
+	if annotateSource.IsSet {
+		annotations[sourceAnnotation] = source
+	}
+	iter := read.Keys(context.Background())
+	for iter.Next(context.Background()) {
+		//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
+		key := iter.Pair().Value.(jwk.Key)
+		for name, value := range annotations {
+			if err = key.Set(name, value); err != nil {
+				return err
+			}
+		}
+		if kid.IsSet {
+			if err = assignKeyID(key, kid.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return addAllKeys(read, set)
+}
+
+// sourceAnnotation is the property set by -annotate.source.
+const sourceAnnotation = "x-jwknife-source"
+
+type mirrorStrategy string
+
+const (
+	strategyOrdered mirrorStrategy = "ordered"
+	strategyRace    mirrorStrategy = "race"
+)
+
+func parseMirrorStrategy(value string) (mirrorStrategy, error) {
+	switch mirrorStrategy(value) {
+	case strategyOrdered, strategyRace:
+		return mirrorStrategy(value), nil
+	default:
+		return "", errors.New("unsupported value for --url.strategy")
+	}
+}
+
+// mirror is one of several sources for a single logical read.
+type mirror struct {
+	name string
+	read func(ctx context.Context, set jwk.Set) error
+}
+
+// readFromMirrors returns the keys of the first mirror that is read successfully, along with the name of that mirror. If the read is optional and every mirror is missing, the returned set is empty.
+func readFromMirrors(mirrors []mirror, race bool, optional bool) (jwk.Set, string, error) {
+	read, idx, errs := readFirstMirror(mirrors, race)
+	if read != nil {
+		return read, mirrors[idx].name, nil
+	}
+	if optional && !slices.ContainsFunc(errs, func(err error) bool { return !errors.Is(err, errSourceMissing) }) {
+		for _, mirror := range mirrors {
+			logVerbose("skipping optional source %s as it does not exist", mirror.name)
 		}
-		return readFromPath(path.Value, kind, set)
+		return jwk.NewSet(), "", nil
+	}
+	if len(mirrors) == 1 {
+		return nil, "", errs[0]
+	}
+	for idx, mirror := range mirrors {
+		errs[idx] = fmt.Errorf("%s: %w", mirror.name, errs[idx])
 	}
+	return nil, "", fmt.Errorf("all mirrors failed:\n%w", errors.Join(errs...))
+}
 
-	panic("unreachable")
+// readFirstMirror returns the keys and index of the first mirror that is read successfully, or the error for each mirror if none succeed. Each mirror is read into its own set, so that a failure part-way through parsing does not leave partial results behind. When racing, all mirrors are read concurrently, and the remaining reads are cancelled once one succeeds.
+func readFirstMirror(mirrors []mirror, race bool) (jwk.Set, int, []error) {
+	errs := make([]error, len(mirrors))
+	if !race {
+		for idx, mirror := range mirrors {
+			read := jwk.NewSet()
+			if err := mirror.read(context.Background(), read); err != nil {
+				logVerbose("reading %s failed: %v", mirror.name, err)
+				errs[idx] = err
+				continue
+			}
+			return read, idx, nil
+		}
+		return nil, 0, errs
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		idx  int
+		read jwk.Set
+		err  error
+	}
+	results := make(chan result, len(mirrors))
+	for idx, mirror := range mirrors {
+		go func() {
+			read := jwk.NewSet()
+			err := mirror.read(ctx, read)
+			results <- result{idx: idx, read: read, err: err}
+		}()
+	}
+	var winner jwk.Set
+	var winnerIdx int
+	for range mirrors {
+		res := <-results
+		switch {
+		case winner != nil:
+		case res.err != nil:
+			logVerbose("reading %s failed: %v", mirrors[res.idx].name, res.err)
+			errs[res.idx] = res.err
+		default:
+			winner, winnerIdx = res.read, res.idx
+			cancel()
+		}
+	}
+	if winner == nil {
+		return nil, 0, errs
+	}
+	return winner, winnerIdx, nil
 }
 
-func readFromPath(arg string, kind contentKind, set jwk.Set) error {
+// errSourceMissing is returned when a source does not exist, which -optional allows.
+var errSourceMissing = errors.New("source does not exist")
+
+func readFromPath(arg string, kind contentKind, password []byte, set jwk.Set) error {
 	contents, err := os.ReadFile(arg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", errSourceMissing, err)
+	}
 	if err != nil {
 		return err
 	}
-	return parseContents(contents, kind, set)
+	return parseContents(contents, kind, password, set)
 }
 
-func readFromURL(from *neturl.URL, conf httpConf, kind contentKind, set jwk.Set) error {
+func readFromURL(ctx context.Context, from *neturl.URL, conf httpConf, kind contentKind, password []byte, optional bool, set jwk.Set) error {
 	if from.Scheme == "file" {
 		if from.Opaque != "" {
 			path, err := neturl.PathUnescape(from.Opaque)
 			if err != nil {
 				return err
 			}
-			return readFromPath(path, kind, set)
+			return readFromPath(path, kind, password, set)
 		}
 		if from.Host == "" || from.Host == "localhost" {
 			if !from.ForceQuery && from.RawQuery == "" && from.Fragment == "" {
-				return readFromPath(from.Path, kind, set)
+				return readFromPath(from.Path, kind, password, set)
 			}
 		}
 		return errors.New("unsupported file URL")
@@ -183,7 +389,11 @@ func readFromURL(from *neturl.URL, conf httpConf, kind contentKind, set jwk.Set)
 			panic(err.Error())
 		}
 
-		resp, err := conf.Do(req, func(resp *http.Response) error {
+		resp, err := conf.Do(ctx, req, func(resp *http.Response) error {
+			if optional && resp.StatusCode == http.StatusNotFound {
+				// Retrying is pointless when a missing source is acceptable
+				return permanentError{fmt.Errorf("%w: URL returned not found status", errSourceMissing)}
+			}
 			if resp.StatusCode != http.StatusOK {
 				return errors.New("URl returned non-OK status")
 			}
@@ -201,7 +411,7 @@ func readFromURL(from *neturl.URL, conf httpConf, kind contentKind, set jwk.Set)
 			return err
 		}
 
-		return parseContents(buf.Bytes(), kind, set)
+		return parseContents(buf.Bytes(), kind, password, set)
 	}
 
 	return errors.New("unsupported URL scheme")
@@ -214,15 +424,55 @@ const (
 	kindJWK contentKind = "jwk"
 )
 
-func parseContents(contents []byte, kind contentKind, set jwk.Set) error {
-	read, err := jwk.Parse(contents, jwk.WithPEM(kind == kindPEM))
+// parseContents parses the keys in the contents and adds them to the set. If a password is given, the contents are first decrypted with it.
+func parseContents(contents []byte, kind contentKind, password []byte, set jwk.Set) error {
+	var read jwk.Set
+	var err error
+	if password != nil {
+		if contents, err = decryptWithPassword(contents, password); err != nil {
+			return err
+		}
+	}
+	if kind == kindPEM {
+		read, err = parsePEM(contents)
+	} else {
+		read, err = parseJWKs(contents)
+	}
 	if err != nil {
 		return err
 	}
-	iter := read.Keys(context.Background())
+	return addAllKeys(read, set)
+}
+
+// parsePEM is jwk.Parse with jwk.WithPEM, with added support for Ed448 and X448 keys.
+func parsePEM(contents []byte) (jwk.Set, error) {
+	read := jwk.NewSet()
+	rest := bytes.TrimSpace(contents)
+	for len(rest) > 0 {
+		block, remaining := pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("failed to decode PEM data")
+		}
+		key, is448, err := decodeOKP448PEM(block)
+		if !is448 {
+			key, err = jwk.ParseKey(pem.EncodeToMemory(block), jwk.WithPEM(true))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = read.AddKey(key); err != nil {
+			return nil, err
+		}
+		rest = bytes.TrimSpace(remaining)
+	}
+	return read, nil
+}
+
+func addAllKeys(from jwk.Set, to jwk.Set) error {
+	iter := from.Keys(context.Background())
 	for iter.Next(context.Background()) {
 		//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
-		if err = (set).AddKey(iter.Pair().Value.(jwk.Key)); err != nil {
+		if err := to.AddKey(iter.Pair().Value.(jwk.Key)); err != nil {
 			return err
 		}
 	}
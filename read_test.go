@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// mirrorBehaviour is how a test mirror responds.
+type mirrorBehaviour int
+
+const (
+	mirrorOK mirrorBehaviour = iota
+	mirrorFail
+	// mirrorSlow responds successfully, but only after the other mirrors would have
+	mirrorSlow
+)
+
+// newMirror starts a HTTP server serving a JWK set with a single key, whose kid is the given name.
+func newMirror(t *testing.T, name string, behaviour mirrorBehaviour, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch behaviour {
+		case mirrorFail:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		case mirrorSlow:
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		case mirrorOK:
+		}
+		_, _ = w.Write([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0","kid":"` + name + `"}]}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReadMirrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		strategy string
+		mirrors  []mirrorBehaviour
+		// want is the index of the mirror the keys are read from
+		want     int
+		wantHits []int32
+		wantErr  []string
+		maxWait  time.Duration
+	}{
+		{
+			name:     "ordered first succeeds",
+			strategy: "ordered",
+			mirrors:  []mirrorBehaviour{mirrorOK, mirrorOK},
+			want:     0,
+			wantHits: []int32{1, 0},
+		},
+		{
+			name:     "ordered falls back",
+			strategy: "ordered",
+			mirrors:  []mirrorBehaviour{mirrorFail, mirrorFail, mirrorOK},
+			want:     2,
+			wantHits: []int32{1, 1, 1},
+		},
+		{
+			name:     "ordered all fail",
+			strategy: "ordered",
+			mirrors:  []mirrorBehaviour{mirrorFail, mirrorFail},
+			wantHits: []int32{1, 1},
+			wantErr:  []string{"all mirrors failed", "mirror0", "mirror1"},
+		},
+		{
+			name:     "race fastest wins",
+			strategy: "race",
+			mirrors:  []mirrorBehaviour{mirrorSlow, mirrorOK},
+			want:     1,
+			wantHits: []int32{1, 1},
+			maxWait:  400 * time.Millisecond,
+		},
+		{
+			name:     "race falls back",
+			strategy: "race",
+			mirrors:  []mirrorBehaviour{mirrorFail, mirrorSlow},
+			want:     1,
+			wantHits: []int32{1, 1},
+		},
+		{
+			name:     "race all fail",
+			strategy: "race",
+			mirrors:  []mirrorBehaviour{mirrorFail, mirrorFail},
+			wantHits: []int32{1, 1},
+			wantErr:  []string{"all mirrors failed", "mirror0", "mirror1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			args := []string{"-url.strategy=" + test.strategy, "-url.allow-plaintext", "-url.retry.end=0", "-annotate.source"}
+			hits := make([]atomic.Int32, len(test.mirrors))
+			urls := make([]string, len(test.mirrors))
+			for idx, behaviour := range test.mirrors {
+				urls[idx] = newMirror(t, "mirror"+strconv.Itoa(idx), behaviour, &hits[idx]).URL + "/mirror" + strconv.Itoa(idx)
+				args = append(args, "-url="+urls[idx])
+			}
+
+			set := jwk.NewSet()
+			start := time.Now()
+			err := handleRead(args, set)
+			if test.maxWait != 0 && time.Since(start) > test.maxWait {
+				t.Errorf("took %v, expected the fastest mirror to win", time.Since(start))
+			}
+			if len(test.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, want := range test.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("got error %q, expected it to contain %q", err, want)
+					}
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				key, _ := set.Key(0)
+				if set.Len() != 1 || key.KeyID() != "mirror"+strconv.Itoa(test.want) {
+					t.Fatalf("got %d keys with first kid %q, expected only the key of mirror%d", set.Len(), key.KeyID(), test.want)
+				}
+				if source, _ := key.Get(sourceAnnotation); source != urls[test.want] {
+					t.Errorf("got source %v, expected %s", source, urls[test.want])
+				}
+			}
+			for idx := range hits {
+				if got := hits[idx].Load(); got != test.wantHits[idx] {
+					t.Errorf("got %d requests to mirror%d, expected %d", got, idx, test.wantHits[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestReadPathMirrors(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present.json")
+	if err := os.WriteFile(present, []byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0","kid":"present"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.json")
+
+	for _, strategy := range []string{"ordered", "race"} {
+		t.Run(strategy, func(t *testing.T) {
+			set := jwk.NewSet()
+			if err := handleRead([]string{"-url.strategy=" + strategy, "-path=" + missing, "-path=" + present}, set); err != nil {
+				t.Fatal(err)
+			}
+			if key, _ := set.Key(0); set.Len() != 1 || key.KeyID() != "present" {
+				t.Errorf("got %d keys, expected only the key from %s", set.Len(), present)
+			}
+
+			err := handleRead([]string{"-url.strategy=" + strategy, "-path=" + missing, "-path=" + missing + ".2"}, jwk.NewSet())
+			if err == nil || !strings.Contains(err.Error(), "all mirrors failed") {
+				t.Errorf("got error %v, expected all mirrors to fail", err)
+			}
+		})
+	}
+}
+
+func TestReadOptional(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"keys":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/invalid":
+			_, _ = w.Write([]byte(`{"keys":`))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// Without retries, so that the number of requests shows whether 404s are retried
+	url := func(path string) []string {
+		return []string{"-url=" + server.URL + path, "-url.allow-plaintext", "-url.retry.end=0"}
+	}
+	for _, test := range []struct {
+		name     string
+		args     []string
+		wantErr  bool
+		wantHits int32
+	}{
+		{name: "missing path", args: []string{"-optional", "-path=" + filepath.Join(dir, "missing.json")}},
+		{name: "missing path required", args: []string{"-path=" + filepath.Join(dir, "missing.json")}, wantErr: true},
+		{name: "invalid path", args: []string{"-optional", "-path=" + invalid}, wantErr: true},
+		{name: "directory", args: []string{"-optional", "-path=" + dir}, wantErr: true},
+		{name: "not found", args: append([]string{"-optional"}, url("/missing")...), wantHits: 1},
+		{name: "not found required", args: url("/missing"), wantErr: true, wantHits: 1},
+		{name: "invalid url", args: append([]string{"-optional"}, url("/invalid")...), wantErr: true, wantHits: 1},
+		{name: "unavailable", args: append([]string{"-optional"}, url("/unavailable")...), wantErr: true, wantHits: 1},
+		{name: "one mirror missing", args: []string{"-optional", "-path=" + filepath.Join(dir, "missing.json"), "-path=" + invalid}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hits.Store(0)
+			set := jwk.NewSet()
+			err := handleRead(test.args, set)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, expected error %v", err, test.wantErr)
+			}
+			if err == nil && set.Len() != 0 {
+				t.Errorf("got %d keys, expected none", set.Len())
+			}
+			if hits.Load() != test.wantHits {
+				t.Errorf("got %d requests, expected %d", hits.Load(), test.wantHits)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	mathrand "math/rand"
 	"net/http"
+	neturl "net/url"
 	"time"
 )
 
@@ -15,6 +16,8 @@ type httpConf struct {
 	backoff  float64
 	retryFor time.Duration
 	jitter   float64
+	// proxy selects the proxy for each request. If nil, the proxy is taken from the environment, as with http.DefaultTransport.
+	proxy func(*http.Request) (*neturl.URL, error)
 }
 
 // Hopefully sane defaults, retrying for up to a minute while backing off, with a short-ish per-request timeout of 10s as payloads should be static and small.
@@ -28,8 +31,27 @@ var defaultHTTPConf = httpConf{
 	jitter:   0.1,
 }
 
-func (c httpConf) Do(req *http.Request, accept func(*http.Response) error) (*http.Response, error) {
+// Do makes the request, retrying as configured until the response is accepted, a non-temporary error occurs, or the context is done.
+func (c httpConf) Do(ctx context.Context, req *http.Request, accept func(*http.Response) error) (*http.Response, error) {
 	client := *http.DefaultClient
+	proxy := c.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	//nolint:forcetypeassert // http.DefaultTransport is always a *http.Transport unless replaced, which we don't do
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*neturl.URL, error) {
+		proxyURL, err := proxy(req)
+		switch {
+		case err != nil:
+		case proxyURL == nil:
+			logVerbose("requesting %s without a proxy", req.URL.Redacted())
+		default:
+			logVerbose("requesting %s using proxy %s", req.URL.Redacted(), proxyURL.Redacted())
+		}
+		return proxyURL, err
+	}
+	client.Transport = transport
 	if req.URL.Scheme == "https" {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			// Prevent downgrades from encrypted to unencrypted requests
@@ -60,23 +82,28 @@ func (c httpConf) Do(req *http.Request, accept func(*http.Response) error) (*htt
 				jitter := mathrand.Float64()*c.jitter + 1 //nolint:gosec // non-crypto rand for jitter is not a security concern
 				interval = time.Duration(c.interval.Seconds() * jitter * float64(time.Second))
 			}
-			time.Sleep(interval)
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return nil, errors.Join(lastErr, ctx.Err())
+			}
 			if c.backoff > 1.0 {
 				c.interval = time.Duration(c.interval.Seconds() * c.backoff * float64(time.Second))
 			}
 		}
 
-		ctx := context.Background()
-		var cancel context.CancelFunc = func() {}
+		var reqCtx context.Context
+		var cancel context.CancelFunc
 		if c.timeout != 0 {
-			ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			reqCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		} else {
+			reqCtx, cancel = context.WithCancel(ctx)
 		}
-		req = req.WithContext(ctx)
+		req = req.WithContext(reqCtx)
 
 		resp, err := client.Do(req)
-		cancel()
-
 		if err != nil {
+			cancel()
 			if withTemporary, ok := err.(interface{ Temporary() bool }); ok && withTemporary.Temporary() {
 				lastErr = err
 				continue
@@ -88,11 +115,68 @@ func (c httpConf) Do(req *http.Request, accept func(*http.Response) error) (*htt
 			go func() {
 				_, _ = io.Copy(io.Discard, resp.Body)
 				_ = resp.Body.Close()
+				cancel()
 			}()
+			var permanent permanentError
+			if errors.As(err, &permanent) {
+				return nil, permanent.err
+			}
 			lastErr = err
 			continue
 		}
 
+		// The body is read after returning, so the request context must outlive this call
+		resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 		return resp, nil
 	}
 }
+
+// permanentError is returned by an accept function to stop retrying.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// parseProxyURL parses the value of a -url.proxy flag. The value "none" disables proxying, and is returned as a nil URL.
+func parseProxyURL(value string) (*neturl.URL, error) {
+	if value == "none" {
+		return nil, nil //nolint:nilnil // a nil URL is the parsed form of "none"
+	}
+	proxyURL, err := neturl.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "https" && proxyURL.Scheme != "http" {
+		return nil, errors.New("unsupported scheme for --url.proxy")
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("missing host for --url.proxy")
+	}
+	return proxyURL, nil
+}
+
+// checkProxyURL applies the plaintext rules of the target URL to a parsed -url.proxy value.
+func checkProxyURL(proxyURL *neturl.URL, allowPlaintext bool) error {
+	if proxyURL != nil && proxyURL.Scheme == "http" && !allowPlaintext {
+		return errors.New("plaintext proxy forbidden without -url.allow-plaintext")
+	}
+	return nil
+}
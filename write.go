@@ -2,41 +2,88 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
+	encpem "encoding/pem"
 	"errors"
+	"fmt"
 	"net/http"
 	neturl "net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
 var writeSyntax = strings.TrimSpace(`
-write [-pubkey] [-fullkey] [-jwks] [-pem] [-path=path] [-path.mode=mode] [-path.mkdir=mode] [-url=url] [-url.post] [-url.put] [-url.allow-plaintext] [-url.timeout=duration] [-url.retry.interval=duration] [-url.retry.backoff=float] [-url.retry.end=duration] [-url.retry.jitter=float]
+write [-pubkey] [-fullkey] [-jwks] [-jwk] [-pem [-pem.format=pkcs8|pkcs1|sec1|pkix]] [-csr=kid [-csr.subject=dn] [-csr.san=name] [-csr.keyusage=usage[,...]] [-csr.extkeyusage=usage[,...]]] [-strip=prefix] [-drop-expired [-drop-expired.prefix=prefix]] [-encrypt.password.file=path] [-path=path] [-path.mode=mode] [-path.mkdir=mode] [-path.exists=fail|replace|merge|keep] [-url=url] [-url.post] [-url.put] [-url.allow-plaintext] [-url.proxy=url|none] [-url.timeout=duration] [-url.retry.interval=duration] [-url.retry.backoff=float] [-url.retry.end=duration] [-url.retry.jitter=float]
 `)
 
 var writeSummary = strings.TrimSpace(`
 Write the JWK set.
 
-The set can be written to either a path or a URL. The supported URL schemes are http and https, but http is only enabled when the -allow-plaintext flag is set. By default, or if -pubkey is given, only the public keys are written. Specify -fullkey to write each key in its entirety. By default, or if -jwks is given, the keys are written as a JWK set. Specify -pem to write the keys as a series of PEM blocks. If a path is specified, the file mode defaults to octal 0400. If a url is specified, the request method defaults to PUT. Specify -post to use a POST request.
+The set can be written to either a path or a URL. The supported URL schemes are http and https, but http is only enabled when the -allow-plaintext flag is set. Requests use the proxy given by the environment unless -url.proxy is given; a proxy with the http scheme also requires -url.allow-plaintext. If a url is specified, the request method defaults to PUT. Specify -post to use a POST request.
+
+By default, or if -pubkey is given, only the public keys are written, without the "key_ops" that need the private key, such as sign and decrypt. Specify -fullkey to write each key in its entirety. OCT (symmetric) keys have no public key, so they are excluded unless -fullkey is given, and can never be written as PEM. Post-quantum (AKP) keys also cannot be written as PEM. By default, or if -jwks is given, the keys are written as a JWK set. Specify -jwk to write a single key as a JWK, rather than a set; this fails unless exactly one key is written, after excluding OCT keys for -pubkey.
+
+Specify -pem to write the keys as a series of PEM blocks. By default, RSA private keys are written in PKCS #1 form, EC private keys in SEC 1 form, other private keys in PKCS #8 form, and public keys in PKIX form. Specify -pem.format to choose the form instead: pkcs8 for private keys as "PRIVATE KEY" blocks, pkcs1 for RSA keys as "RSA PRIVATE KEY" or "RSA PUBLIC KEY" blocks, sec1 for EC private keys as "EC PRIVATE KEY" blocks, or pkix for public keys as "PUBLIC KEY" blocks. It is an error if any of the keys cannot be written in the chosen form.
+
+Specify -strip to remove custom properties from the JWK set, such as the annotations added by read; PEM blocks never include properties. Specify -drop-expired to leave out keys whose "x-jwknife-exp" property, as recorded by gen -valid-for, is a time that has passed; keys that are not yet valid according to "x-jwknife-nbf" are kept, so that they can be published ahead of use. The prefix of the property defaults to "x-jwknife-", and can be changed using -drop-expired.prefix to match gen -stamp.prefix.
+
+Specify -encrypt.password.file to encrypt the JWK set or JWK with a password read from the file, without a single trailing newline, for example to back up private keys. The password must be at least 20 bytes long, as the key is derived from it with only 10000 PBES2 iterations; a long random passphrase is best. The keys are then written as a JWE in compact serialization using PBES2-HS512+A256KW and A256GCM, with the "cty" header set to "jwk-set+json" or "jwk+json", which can be read using read -decrypt.password.file.
+
+Specify -csr to instead write a PKCS #10 certificate signing request (CSR) in PEM form for the key with the given "kid", which must be an RSA, EC or Ed25519 private key. The subject, subject alternative names and requested key usages of the CSR are given by the -csr.* flags.
+
+If a path is specified, the file mode defaults to octal 0400. The file is written atomically, by writing and syncing a temporary file in the same directory and then renaming it over the destination, so that other readers never see a partially written file. Symlinks are followed, so that the file they refer to is replaced rather than the link. Devices and named pipes are written in place instead, paths naming an open file descriptor, such as /dev/stdout, are written to that descriptor, and other paths that aren't regular files are an error. Missing parent directories are only created if -path.mkdir is given. If the file already exists, -path.exists decides what happens: fail gives an error, replace (the default) replaces the file even if it's read-only, keep leaves the existing file as it is, and merge reads the existing JWK set from the file and adds the keys that aren't already in it, as identified by their thumbprint, before writing the result. With fail and keep, the new file is linked into place so that it's never written over a file created concurrently, except on filesystems without hard links such as vfat, where it's created exclusively and written directly. Keys already in the file are kept as they are, apart from the changes made by -pubkey and -strip.
 `)
 
 var writeFlags = strings.TrimSpace(`
 -pubkey                      Write public key forms of each key.
 -fullkey                     Write the full key for each key.
 -jwks                        Write the keys as a JWK set.
+-jwk                         Write the only key as a single JWK.
 -pem                         Write the keys as a series of PEM blocks.
+-pem.format=format           The form of the PEM blocks: pkcs8, pkcs1, sec1 or pkix. Defaults to
+                             the usual form for each key.
+-csr=kid                     Write a certificate signing request for the private key with the given
+                             kid.
+-csr.subject=dn              The subject distinguished name of the CSR, such as CN=example,O=Corp.
+-csr.san=name                Add a subject alternative name to the CSR. IP addresses, URIs
+                             (containing ://) and email addresses (containing @) are detected;
+                             anything else is a DNS name. May be repeated.
+-csr.keyusage=usage[,...]    Request the key usages, from digitalSignature, contentCommitment,
+                             keyEncipherment, dataEncipherment, keyAgreement, keyCertSign and
+                             cRLSign.
+-csr.extkeyusage=usage[,...] Request the extended key usages, from serverAuth, clientAuth,
+                             codeSigning, emailProtection, timeStamping and OCSPSigning.
+-strip=prefix                Remove non-standard properties whose names start with the prefix, such
+                             as those added by read -annotate. May be repeated.
+-drop-expired                Leave out keys whose "x-jwknife-exp" time has passed.
+-drop-expired.prefix=prefix  The prefix of the exp property for -drop-expired. Defaults to
+                             "x-jwknife-".
+-encrypt.password.file=path  Encrypt the JWK set or JWK as a JWE, using the password in the file.
 -path=path                   Write the keys to a file at the given path.
 -path.mode=mode              The permission mode of the file when a path is given.
 -path.mkdir=mode             Create missing parent directories with the given permission mode.
+-path.exists=policy          What to do when the file already exists: fail, replace, merge or keep.
+                             Defaults to replace.
 -url=url                     Write the file to the given URL.
 -url.post                    When a HTTP(S) URL is given, make a POST request.
 -url.put                     When a HTTP(S) URL is given, make a PUT request.
 -url.allow-plaintext         Allow plaintext traffic when writing the file using a request.
+-url.proxy=url|none          The proxy to use for HTTP(S) requests, or none to disable proxying.
+                             Defaults to the proxy given by the environment.
 -url.timeout=duration        Timeout for a remote read. Default is 10s.
 -url.retry.interval=duration Interval after a failed remote read before retrying. Default is 1s.
 -url.retry.backoff=float     Multiplier applied to the interval after each attempt. Default is 1.5.
@@ -52,7 +99,9 @@ func handleWrite(args []string, set jwk.Set) error {
 		pubkey     = addNoValueFlag(writeflags, "pubkey")
 		fullkey    = addNoValueFlag(writeflags, "fullkey")
 		jwks       = addNoValueFlag(writeflags, "jwks")
+		single     = addNoValueFlag(writeflags, "jwk")
 		pem        = addNoValueFlag(writeflags, "pem")
+		strip      = addUnparsedSliceFlag(writeflags, "strip")
 		path       = addUnparsedFlag(writeflags, "path")
 		mode       = addValueFlag[uint32](writeflags, "path.mode", func(value string) (uint32, error) {
 			parsed, err := strconv.ParseUint(value, 8, 32)
@@ -74,15 +123,41 @@ func handleWrite(args []string, set jwk.Set) error {
 			}
 			return uint32(parsed), nil
 		})
+		exists = addValueFlag[string](writeflags, "path.exists", func(value string) (string, error) {
+			switch value {
+			case "fail", "replace", "merge", "keep":
+				return value, nil
+			default:
+				return "", errors.New("unsupported value for --path.exists")
+			}
+		})
 		url       = addValueFlag[*neturl.URL](writeflags, "url", neturl.Parse)
 		post      = addNoValueFlag(writeflags, "url.post")
 		put       = addNoValueFlag(writeflags, "url.put")
 		plaintext = addNoValueFlag(writeflags, "url.allow-plaintext")
+		proxy     = addValueFlag[*neturl.URL](writeflags, "url.proxy", parseProxyURL)
 		timeout   = addValueFlag[time.Duration](writeflags, "url.timeout", parseNonNegativeDuration)
 		interval  = addValueFlag[time.Duration](writeflags, "url.retry.interval", parseNonNegativeDuration)
 		backoff   = addValueFlag[float64](writeflags, "url.retry.backoff", parseMultiplier)
 		retryEnd  = addValueFlag[time.Duration](writeflags, "url.retry.end", parseNonNegativeDuration)
 		jitter    = addValueFlag[float64](writeflags, "url.retry.jitter", parseNonNegativeFloat)
+
+		csr         = addUnparsedFlag(writeflags, "csr")
+		csrOpts     certOptions
+		csrSubject  = addValueFlag[pkix.Name](writeflags, "csr.subject", parseDistinguishedName)
+		_           = addExternalFlag(writeflags, "csr.san", csrOpts.addSubjectAltName)
+		csrKeyUsage = addValueFlag[x509.KeyUsage](writeflags, "csr.keyusage", parseKeyUsage)
+		csrExtUsage = addValueFlag[[]asn1.ObjectIdentifier](writeflags, "csr.extkeyusage", parseExtKeyUsage)
+
+		pemFormat = addValueFlag[string](writeflags, "pem.format", func(value string) (string, error) {
+			if _, known := pemFormats[value]; !known {
+				return "", errors.New("unsupported value for --pem.format")
+			}
+			return value, nil
+		})
+		encrypt       = addUnparsedFlag(writeflags, "encrypt.password.file")
+		dropExpired   = addNoValueFlag(writeflags, "drop-expired")
+		expiredPrefix = addUnparsedFlag(writeflags, "drop-expired.prefix")
 	)
 
 	for _, arg := range args {
@@ -102,12 +177,18 @@ func handleWrite(args []string, set jwk.Set) error {
 		}
 	}
 
-	if err := oneOf(true, jwks.Iface(), pem.Iface()); err != nil {
+	if err := oneOf(true, jwks.Iface(), single.Iface(), pem.Iface(), csr.Iface()); err != nil {
 		return err
-	} else if !pem.IsSet {
+	} else if !single.IsSet && !pem.IsSet && !csr.IsSet {
 		// Set default to avoid bugs
 		jwks.IsSet = true
 	}
+	for _, flag := range []flag{pubkey.Iface(), fullkey.Iface(), strip.Iface(), dropExpired.Iface()} {
+		// A CSR only contains the public key, derived from the private key that signs it
+		if err := oneOf(true, csr.Iface(), flag); err != nil {
+			return err
+		}
+	}
 	if err := oneOf(true, pubkey.Iface(), fullkey.Iface()); err != nil {
 		return err
 	} else if !fullkey.IsSet {
@@ -132,56 +213,189 @@ func handleWrite(args []string, set jwk.Set) error {
 	if err := oneOf(true, post.Iface(), put.Iface()); err != nil {
 		return err
 	}
+	for name, flag := range writeflags {
+		if strings.HasPrefix(name, "csr.") && flag.IsSet() && !csr.IsSet {
+			return errors.New("--" + name + " requires --csr")
+		}
+	}
+	if pemFormat.IsSet && !pem.IsSet {
+		return errors.New("--pem.format requires --pem")
+	}
+	if expiredPrefix.IsSet && !dropExpired.IsSet {
+		return errors.New("--drop-expired.prefix requires --drop-expired")
+	} else if !expiredPrefix.IsSet {
+		expiredPrefix.Value = defaultStampPrefix
+	} else if expiredPrefix.Value == "" {
+		return errors.New("value for --drop-expired.prefix must not be empty")
+	}
+	if exists.Value == "merge" && !jwks.IsSet {
+		return errors.New("--path.exists=merge requires --jwks")
+	} else if !exists.IsSet {
+		// Set default to avoid bugs
+		exists.Value = "replace"
+	}
+	var password []byte
+	if encrypt.IsSet {
+		if !jwks.IsSet && !single.IsSet {
+			return errors.New("--encrypt.password.file requires --jwks or --jwk")
+		}
+		var err error
+		if password, err = readPasswordFile(encrypt.Value); err != nil {
+			return err
+		}
+		if len(password) < minPasswordLength {
+			return errors.New("password in " + encrypt.Value + " is too short, must be at least " + strconv.Itoa(minPasswordLength) + " bytes")
+		}
+	}
+	if csr.IsSet {
+		csrOpts.subject = csrSubject.Value
+		assignIfSet(csrKeyUsage, &csrOpts.keyUsage)
+		assignIfSet(csrExtUsage, &csrOpts.extKeyUsage)
+	}
 
 	encode := func() (string, error) {
-		switch pem.IsSet {
-		case true:
+		if dropExpired.IsSet {
+			var err error
+			// Applied when encoding, so that expired keys merged from an existing file are also dropped
+			if set, err = dropExpiredKeys(set, expiredPrefix.Value+"exp", time.Now()); err != nil {
+				return "", err
+			}
+		}
+		switch {
+		case csr.IsSet:
+			key, found := set.LookupKeyID(csr.Value)
+			if !found {
+				return "", errors.New("no key with kid " + csr.Value + " for --csr")
+			}
+			if isPrivate, err := jwk.IsPrivateKey(key); err != nil {
+				return "", errors.New("--csr requires an asymmetric key")
+			} else if !isPrivate {
+				return "", errors.New("--csr requires a private key")
+			}
+			var rawKey any
+			if err := key.Raw(&rawKey); err != nil {
+				return "", err
+			}
+			der, err := createCSR(rawKey, csrOpts)
+			if err != nil {
+				return "", err
+			}
+			return string(encpem.EncodeToMemory(&encpem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+		case pem.IsSet:
 			var builder strings.Builder
 			keys := set.Keys(context.Background())
 			for keys.Next(context.Background()) {
 				//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
 				var key = keys.Pair().Value.(jwk.Key)
+				if key.KeyType() == jwa.OctetSeq {
+					if pubkey.IsSet {
+						logVerbose("excluding OCT key %q which has no public key", key.KeyID())
+						continue
+					}
+					return "", errors.New("OCT keys cannot be written as PEM")
+				}
 				if pubkey.IsSet {
 					var err error
 					if key, err = key.PublicKey(); err != nil {
 						return "", err
 					}
 				}
-				b, err := jwk.EncodePEM(key)
+				b, err := encodePEM(key, pemFormat.Value)
 				if err != nil {
 					return "", err
 				}
 				_, _ = builder.Write(b)
 			}
 			return builder.String(), nil
-		case false:
-			if pubkey.IsSet {
-				pubset := jwk.NewSet()
+		default:
+			if pubkey.IsSet || strip.IsSet {
+				outset := jwk.NewSet()
 				keys := set.Keys(context.Background())
 				for keys.Next(context.Background()) {
 					//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
 					var key = keys.Pair().Value.(jwk.Key)
 					var err error
-					if key, err = key.PublicKey(); err != nil {
-						return "", err
+					if pubkey.IsSet {
+						if key.KeyType() == jwa.OctetSeq {
+							logVerbose("excluding OCT key %q which has no public key", key.KeyID())
+							continue
+						}
+						if key, err = publicKey(key); err != nil {
+							return "", err
+						}
 					}
-					if err := pubset.AddKey(key); err != nil {
+					if strip.IsSet {
+						if key, err = stripParams(key, strip.Value); err != nil {
+							return "", err
+						}
+					}
+					if err := outset.AddKey(key); err != nil {
 						return "", err
 					}
 				}
-				set = pubset
+				set = outset
+			}
+			if single.IsSet {
+				// Refuse to pick one of several keys, so that the wrong key is never written
+				if set.Len() != 1 {
+					return "", errors.New("--jwk requires exactly one key, but there are " + strconv.Itoa(set.Len()))
+				}
+				key, _ := set.Key(0)
+				b, err := json.Marshal(key)
+				if err != nil {
+					return "", err
+				}
+				return string(b), nil
 			}
 			b, err := json.Marshal(set)
 			if err != nil {
 				return "", err
 			}
 			return string(b), nil
-		default:
-			panic("unreachable")
+		}
+	}
+
+	if password != nil {
+		encodeKeys := encode
+		encode = func() (string, error) {
+			content, err := encodeKeys()
+			if err != nil {
+				return "", err
+			}
+			cty := ctyJWKSet
+			if single.IsSet {
+				cty = ctyJWK
+			}
+			encrypted, err := encryptWithPassword([]byte(content), password, cty)
+			if err != nil {
+				return "", err
+			}
+			return string(encrypted), nil
 		}
 	}
 
 	if path.IsSet {
+		if exists.Value == "merge" {
+			existing, err := os.ReadFile(path.Value)
+			switch {
+			case err == nil && password != nil:
+				// The existing file was encrypted with the same password
+				if existing, err = decryptWithPassword(existing, password); err != nil {
+					return err
+				}
+				fallthrough
+			case err == nil:
+				existingSet, err := parseJWKs(existing)
+				if err != nil {
+					return err
+				}
+				if set, err = mergeSets(existingSet, set); err != nil {
+					return err
+				}
+			case !os.IsNotExist(err):
+				return err
+			}
+		}
 		encoded, err := encode()
 		if err != nil {
 			return err
@@ -190,14 +404,21 @@ func handleWrite(args []string, set jwk.Set) error {
 		if mode.IsSet {
 			filemode = os.FileMode(mode.Value)
 		}
-		err = os.WriteFile(path.Value, []byte(encoded), filemode)
-		if os.IsNotExist(err) && mkdir.IsSet {
-			if err = os.MkdirAll(filepath.Base(path.Value), os.FileMode(mkdir.Value)); err != nil {
+		if mkdir.IsSet {
+			if err = os.MkdirAll(filepath.Dir(path.Value), os.FileMode(mkdir.Value)); err != nil {
 				return err
 			}
-			err = os.WriteFile(path.Value, []byte(encoded), filemode)
 		}
-		return err
+		err = writeFileAtomic(path.Value, []byte(encoded), filemode, exists.Value == "replace" || exists.Value == "merge")
+		switch {
+		case errors.Is(err, os.ErrExist) && exists.Value == "keep":
+			logVerbose("keeping existing file %q", path.Value)
+			return nil
+		case errors.Is(err, os.ErrExist):
+			return errors.New("file " + path.Value + " already exists, use --path.exists to replace it")
+		default:
+			return err
+		}
 	}
 
 	if url.IsSet {
@@ -207,6 +428,9 @@ func handleWrite(args []string, set jwk.Set) error {
 		default:
 			return errors.New("unsupported scheme for --url")
 		}
+		if err := checkProxyURL(proxy.Value, plaintext.IsSet); err != nil {
+			return err
+		}
 
 		encoded, err := encode()
 		if err != nil {
@@ -223,6 +447,9 @@ func handleWrite(args []string, set jwk.Set) error {
 		assignIfSet(backoff, &reqConf.backoff)
 		assignIfSet(retryEnd, &reqConf.retryFor)
 		assignIfSet(jitter, &reqConf.jitter)
+		if proxy.IsSet {
+			reqConf.proxy = http.ProxyURL(proxy.Value)
+		}
 
 		return writeToURL(encoded, method, url.Value, reqConf)
 	}
@@ -230,6 +457,344 @@ func handleWrite(args []string, set jwk.Set) error {
 	panic("unreachable")
 }
 
+// writeFileAtomic writes the file by renaming a temporary file in the same directory over it, so that readers never see a partially written file. The file and the directory are synced, so that the new file survives a crash once written. Symlinks, including dangling ones, are resolved first, so that the file they refer to is replaced rather than the link. Devices and named pipes are written in place, and paths naming an open file descriptor, such as /dev/stdout, are written to that descriptor, while other paths that aren't regular files, such as directories, give an error. Unless replace is true, an existing file is left as it is and an error satisfying errors.Is(err, os.ErrExist) is returned; on filesystems without hard links, the file is then created exclusively and written directly instead.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, replace bool) (err error) {
+	if file, isOpen := openFileForPath(path); isOpen {
+		// Reopening would truncate a redirected file and write at a different offset than the shell
+		_, err = file.Write(data)
+		return err
+	}
+	if path, err = resolveSymlinks(path); err != nil {
+		return err
+	}
+	if info, statErr := os.Lstat(path); statErr == nil && !info.Mode().IsRegular() {
+		if info.Mode()&(os.ModeDevice|os.ModeNamedPipe) == 0 {
+			return errors.New(path + " is not a regular file")
+		}
+		if !replace {
+			return &os.PathError{Op: "write", Path: path, Err: os.ErrExist}
+		}
+		return os.WriteFile(path, data, perm)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if replace {
+		// Renaming replaces the file even if it's read-only, as only the directory is modified
+		if err = os.Rename(tmp.Name(), path); err != nil {
+			return err
+		}
+	} else {
+		// Unlike renaming, linking fails if the file exists, without a window for another writer to create it after a check
+		err = linkFile(tmp.Name(), path)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			// Filesystems such as vfat, SMB and many FUSE filesystems don't support hard links
+			err = writeFileExclusive(path, data, perm)
+		}
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(tmp.Name()); err != nil {
+			return err
+		}
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = dirFile.Sync()
+	if closeErr := dirFile.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
+
+// writeFileExclusive creates the file and writes it, failing if the file exists. Unlike writeFileAtomic, a partially written file is visible to readers, but it is removed if writing fails.
+func writeFileExclusive(path string, data []byte, perm os.FileMode) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(path)
+		}
+	}()
+	if err = file.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// maxSymlinks limits the symlinks followed by openFileForPath and resolveSymlinks.
+const maxSymlinks = 40
+
+// linkFile is os.Link, which tests replace to simulate filesystems without hard links.
+var linkFile = os.Link
+
+// resolveSymlinks returns the path with symlinks resolved. Unlike filepath.EvalSymlinks, a dangling symlink resolves to the path of the missing file it refers to.
+func resolveSymlinks(path string) (string, error) {
+	for range maxSymlinks {
+		resolved, err := filepath.EvalSymlinks(path)
+		if !os.IsNotExist(err) {
+			return resolved, err
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			// The file itself is missing rather than the target of a symlink
+			return path, nil //nolint:nilerr // A missing file is created in its place
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", errors.New("too many levels of symbolic links in " + path)
+}
+
+// openFiles keeps the files created for file descriptors by openFileForPath, as an *os.File closes its descriptor once garbage collected. It is guarded by openFilesMu.
+var (
+	openFiles   = map[uintptr]*os.File{}
+	openFilesMu sync.Mutex
+)
+
+// openFileForPath returns the file the process already has open if the path names one of its file descriptors, such as /dev/stdout, /dev/fd/3 or /proc/self/fd/3, directly or through symlinks.
+func openFileForPath(path string) (*os.File, bool) {
+	selfFDs := "/proc/" + strconv.Itoa(os.Getpid()) + "/fd/"
+	for range maxSymlinks {
+		path = filepath.Clean(path)
+		switch path {
+		case "/dev/stdout":
+			return os.Stdout, true
+		case "/dev/stderr":
+			return os.Stderr, true
+		}
+		for _, prefix := range []string{"/dev/fd/", "/proc/self/fd/", selfFDs} {
+			if fdstr, isFD := strings.CutPrefix(path, prefix); isFD {
+				fd, err := strconv.ParseUint(fdstr, 10, 31)
+				if err != nil {
+					return nil, false
+				}
+				openFilesMu.Lock()
+				defer openFilesMu.Unlock()
+				if openFiles[uintptr(fd)] == nil {
+					openFiles[uintptr(fd)] = os.NewFile(uintptr(fd), path)
+				}
+				return openFiles[uintptr(fd)], true
+			}
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, false
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return nil, false
+}
+
+// dropExpiredKeys returns the keys of the set, except those whose expiry time, given by the property in the form recorded by gen -valid-for, is at or before now.
+func dropExpiredKeys(set jwk.Set, expParam string, now time.Time) (jwk.Set, error) {
+	kept := jwk.NewSet()
+	keys := set.Keys(context.Background())
+	for keys.Next(context.Background()) {
+		//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
+		key := keys.Pair().Value.(jwk.Key)
+		value, haveExp := key.Get(expParam)
+		if haveExp {
+			var exp int64
+			// Generated keys hold an int64, while keys that have been read hold the float64 given by JSON
+			switch value := value.(type) {
+			case int64:
+				exp = value
+			case float64:
+				exp = int64(value)
+			default:
+				return nil, fmt.Errorf("%s field of key %q must be a number", expParam, key.KeyID())
+			}
+			if !now.Before(time.Unix(exp, 0)) {
+				logVerbose("dropping key %q which expired at %s", key.KeyID(), time.Unix(exp, 0).UTC().Format(time.RFC3339))
+				continue
+			}
+		}
+		if err := kept.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// publicKey gives the public key of the key. The key_ops that need the private key are removed, along with the key_ops property if none remain, so that the public key's properties are consistent with it.
+func publicKey(key jwk.Key) (jwk.Key, error) {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	ops := pub.KeyOps()
+	if len(ops) == 0 {
+		return pub, nil
+	}
+	kept := slices.DeleteFunc(slices.Clone(ops), func(op jwk.KeyOperation) bool {
+		return slices.Contains(privateOps, op)
+	})
+	if len(kept) == 0 {
+		return pub, pub.Remove(jwk.KeyOpsKey)
+	}
+	return pub, pub.Set(jwk.KeyOpsKey, []jwk.KeyOperation(kept))
+}
+
+// mergeSets returns the union of the keys in existing and set, in that order. Keys in set with the same thumbprint as a key in existing are omitted, so the existing keys are kept as they are. The sets must not be modified concurrently, which holds as commands run one after another, and gen only adds its keys to the set once they have all been generated.
+func mergeSets(existing jwk.Set, set jwk.Set) (jwk.Set, error) {
+	merged := jwk.NewSet()
+	thumbprints := make(map[string]bool)
+	for _, from := range []jwk.Set{existing, set} {
+		keys := from.Keys(context.Background())
+		for keys.Next(context.Background()) {
+			//nolint:forcetypeassert // It would be a bug if iterating over keys didn't give us a jwk.Key
+			var key = keys.Pair().Value.(jwk.Key)
+			thumbprint, err := key.Thumbprint(crypto.SHA256)
+			if err != nil {
+				return nil, err
+			}
+			if thumbprints[string(thumbprint)] {
+				logVerbose("omitting key %q which is already in the file", key.KeyID())
+				continue
+			}
+			thumbprints[string(thumbprint)] = true
+			if err = merged.AddKey(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return merged, nil
+}
+
+// pemFormats describe the keys supported by each -pem.format.
+var pemFormats = map[string]string{
+	"pkcs8": "private keys",
+	"pkcs1": "RSA keys",
+	"sec1":  "EC private keys",
+	"pkix":  "public keys",
+}
+
+// encodePEM is jwk.EncodePEM with added support for Ed448 and X448 keys, and for choosing the format of the PEM block. An empty format uses the format chosen by jwk.EncodePEM.
+func encodePEM(key jwk.Key, format string) ([]byte, error) {
+	if key.KeyType() == ktyAKP {
+		return nil, errors.New("AKP keys cannot be written as PEM")
+	}
+	if format == "" {
+		if crv, is448 := okp448Curve(key); is448 {
+			return encodeOKP448PEM(key, crv)
+		}
+		return jwk.EncodePEM(key)
+	}
+
+	unsupported := errors.New("--pem.format=" + format + " only supports " + pemFormats[format] + ", cannot write key " + strconv.Quote(key.KeyID()))
+	isPrivate, err := jwk.IsPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if crv, is448 := okp448Curve(key); is448 {
+		// Ed448 and X448 keys are always encoded as PKCS #8 or PKIX
+		if (format == "pkcs8" && isPrivate) || (format == "pkix" && !isPrivate) {
+			return encodeOKP448PEM(key, crv)
+		}
+		return nil, unsupported
+	}
+	var rawKey any
+	if err = key.Raw(&rawKey); err != nil {
+		return nil, err
+	}
+	var block encpem.Block
+	switch rawKey := rawKey.(type) {
+	case *rsa.PrivateKey:
+		if format == "pkcs1" {
+			block.Type, block.Bytes = "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rawKey)
+		}
+	case *rsa.PublicKey:
+		if format == "pkcs1" {
+			block.Type, block.Bytes = "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(rawKey)
+		}
+	case *ecdsa.PrivateKey:
+		if format == "sec1" {
+			block.Type = "EC PRIVATE KEY"
+			if block.Bytes, err = x509.MarshalECPrivateKey(rawKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch {
+	case block.Type != "":
+	case format == "pkcs8" && isPrivate:
+		block.Type = "PRIVATE KEY"
+		if block.Bytes, err = x509.MarshalPKCS8PrivateKey(rawKey); err != nil {
+			return nil, err
+		}
+	case format == "pkix" && !isPrivate:
+		block.Type = "PUBLIC KEY"
+		if block.Bytes, err = x509.MarshalPKIXPublicKey(rawKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, unsupported
+	}
+	return encpem.EncodeToMemory(&block), nil
+}
+
+// stripParams returns a copy of the key without the non-standard properties whose names start with any of the prefixes.
+func stripParams(key jwk.Key, prefixes []string) (jwk.Key, error) {
+	key, err := key.Clone()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range key.PrivateParams() {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	for _, name := range names {
+		if err = key.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
 func writeToURL(content string, method string, url *neturl.URL, conf httpConf) error {
 	//nolint:noctx // the retrier manages the timeout
 	req, err := http.NewRequest(method, url.String(), strings.NewReader(content))
@@ -238,7 +803,7 @@ func writeToURL(content string, method string, url *neturl.URL, conf httpConf) e
 		panic(err.Error())
 	}
 
-	resp, err := conf.Do(req, func(resp *http.Response) error {
+	resp, err := conf.Do(context.Background(), req, func(resp *http.Response) error {
 		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 			return errors.New("URl returned non-OK status")
 		}
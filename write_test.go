@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// writeToFile writes the set using the write command with the given flags, and returns the file's contents.
+func writeToFile(t *testing.T, set jwk.Set, args ...string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "out")
+	if err := handleWrite(append(args, "-path="+path), set); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestWritePublicKeyOps(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		// want is the key_ops of the public key, where nil means no key_ops property
+		want []jwk.KeyOperation
+	}{
+		{args: []string{"-alg=ES256"}, want: []jwk.KeyOperation{jwk.KeyOpVerify}},
+		{args: []string{"-alg=EdDSA", "-setstr=crv=Ed25519"}, want: []jwk.KeyOperation{jwk.KeyOpVerify}},
+		{args: []string{"-alg=RSA-OAEP"}, want: []jwk.KeyOperation{jwk.KeyOpWrapKey}},
+		{args: []string{"-rsa=2048", `-setjson=key_ops=["encrypt","decrypt"]`}, want: []jwk.KeyOperation{jwk.KeyOpEncrypt}},
+		{args: []string{"-alg=ML-DSA-44"}, want: []jwk.KeyOperation{jwk.KeyOpVerify}},
+		{args: []string{"-alg=ECDH-ES", "-setstr=crv=P-256"}},
+		{args: []string{"-alg=ML-KEM-768"}},
+		{args: []string{"-ec", "-setstr=crv=P-256", `-setjson=key_ops=["sign"]`}},
+		{args: []string{"-ec", "-setstr=crv=P-256"}},
+	} {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			set := jwk.NewSet()
+			if err := handleGen(test.args, set); err != nil {
+				t.Fatal(err)
+			}
+			key, _ := set.Key(0)
+			fullOps := slices.Clone(key.KeyOps())
+
+			written, err := parseKey(writeToFile(t, set, "-pubkey", "-jwk"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, hasOps := written.Get(jwk.KeyOpsKey); hasOps != (test.want != nil) || !slices.Equal(written.KeyOps(), test.want) {
+				t.Errorf("got key_ops %v, expected %v", written.KeyOps(), test.want)
+			}
+			// The key in the set is unchanged
+			if !slices.Equal(key.KeyOps(), fullOps) {
+				t.Errorf("got key_ops %v for the full key, expected %v", key.KeyOps(), fullOps)
+			}
+		})
+	}
+}
+
+func TestWriteDropExpired(t *testing.T) {
+	set := jwk.NewSet()
+	for _, args := range [][]string{
+		{"-alg=ES256", "-setstr=kid=expired", "-setjson=x-jwknife-exp=1"},
+		{"-alg=ES256", "-setstr=kid=valid", "-valid-for=1h"},
+		{"-alg=ES256", "-setstr=kid=unstamped"},
+		{"-alg=ES256", "-setstr=kid=other-prefix", "-setjson=other-exp=1"},
+	} {
+		if err := handleGen(args, set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keys that have been read back hold the times as float64 values rather than int64 values
+	readBack := jwk.NewSet()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := handleWrite([]string{"-fullkey", "-path=" + path}, set); err != nil {
+		t.Fatal(err)
+	}
+	if err := handleRead([]string{"-path=" + path}, readBack); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		set  jwk.Set
+		args []string
+		want []string
+	}{
+		{name: "generated", set: set, args: []string{"-drop-expired"}, want: []string{"valid", "unstamped", "other-prefix"}},
+		{name: "read", set: readBack, args: []string{"-drop-expired"}, want: []string{"valid", "unstamped", "other-prefix"}},
+		{name: "prefix", set: readBack, args: []string{"-drop-expired", "-drop-expired.prefix=other-"}, want: []string{"expired", "valid", "unstamped"}},
+		{name: "not dropped", set: readBack, want: []string{"expired", "valid", "unstamped", "other-prefix"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			written, err := parseJWKs(writeToFile(t, test.set, test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kids []string
+			for idx := range written.Len() {
+				key, _ := written.Key(idx)
+				kids = append(kids, key.KeyID())
+			}
+			if !slices.Equal(kids, test.want) {
+				t.Errorf("got keys %v, expected %v", kids, test.want)
+			}
+		})
+	}
+
+	bad := jwk.NewSet()
+	if err := handleGen([]string{"-alg=ES256", "-setstr=kid=bad", "-setstr=x-jwknife-exp=tomorrow"}, bad); err != nil {
+		t.Fatal(err)
+	}
+	err := handleWrite([]string{"-drop-expired", "-path=" + filepath.Join(t.TempDir(), "out")}, bad)
+	if err == nil || err.Error() != `x-jwknife-exp field of key "bad" must be a number` {
+		t.Errorf("got error %v, expected the exp field to be rejected", err)
+	}
+}
+
+func TestWriteFileAtomicReadOnly(t *testing.T) {
+	for _, viaSymlink := range []bool{false, true} {
+		t.Run("symlink="+strconv.FormatBool(viaSymlink), func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "keys.json")
+			if err := os.WriteFile(target, []byte("old"), 0o400); err != nil {
+				t.Fatal(err)
+			}
+			path, wantEntries := target, 1
+			if viaSymlink {
+				wantEntries = 2
+				path = filepath.Join(dir, "link.json")
+				if err := os.Symlink("keys.json", path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(path, []byte("new"), 0o400, false); !errors.Is(err, os.ErrExist) {
+				t.Errorf("got error %v, expected the existing file to be kept", err)
+			}
+			if err := writeFileAtomic(path, []byte("new"), 0o400, true); err != nil {
+				t.Fatal(err)
+			}
+			if contents, _ := os.ReadFile(target); string(contents) != "new" {
+				t.Errorf("got contents %q, expected %q", contents, "new")
+			}
+			if info, err := os.Lstat(path); err != nil || info.Mode().IsRegular() == viaSymlink {
+				t.Errorf("got %v, expected the path to remain a symlink %v", info, viaSymlink)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != wantEntries {
+				t.Errorf("got %d directory entries, expected no temporary files", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicWithoutLinks(t *testing.T) {
+	linkFile = func(string, string) error { return errors.ErrUnsupported }
+	t.Cleanup(func() { linkFile = os.Link })
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	if err := writeFileAtomic(path, []byte("first"), 0o400, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0o400, false); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, expected the existing file to be kept", err)
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != "first" {
+		t.Errorf("got contents %q, expected %q", contents, "first")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o400 {
+		t.Errorf("got mode %v, expected 0400", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d directory entries, expected no temporary files", len(entries))
+	}
+}
+
+func TestWritePEMFormat(t *testing.T) {
+	for _, test := range []struct {
+		gen    []string
+		full   bool
+		format string
+		// want is the type of the PEM block, where an empty type means the key cannot be written in the format
+		want string
+	}{
+		{gen: []string{"-rsa=2048"}, full: true, format: "pkcs1", want: "RSA PRIVATE KEY"},
+		{gen: []string{"-rsa=2048"}, full: true, format: "pkcs8", want: "PRIVATE KEY"},
+		{gen: []string{"-rsa=2048"}, format: "pkcs1", want: "RSA PUBLIC KEY"},
+		{gen: []string{"-rsa=2048"}, format: "pkix", want: "PUBLIC KEY"},
+		{gen: []string{"-rsa=2048"}, full: true, format: "pkix"},
+		{gen: []string{"-alg=ES256"}, full: true, format: "sec1", want: "EC PRIVATE KEY"},
+		{gen: []string{"-alg=ES256"}, full: true, format: "pkcs8", want: "PRIVATE KEY"},
+		{gen: []string{"-alg=ES256"}, format: "pkix", want: "PUBLIC KEY"},
+		{gen: []string{"-alg=ES256"}, format: "sec1"},
+		{gen: []string{"-alg=ES256"}, full: true, format: "pkcs1"},
+		{gen: []string{"-okp", "-setstr=crv=Ed25519"}, full: true, format: "pkcs8", want: "PRIVATE KEY"},
+		{gen: []string{"-okp", "-setstr=crv=Ed25519"}, format: "pkix", want: "PUBLIC KEY"},
+		{gen: []string{"-okp", "-setstr=crv=Ed25519"}, full: true, format: "sec1"},
+		{gen: []string{"-okp", "-setstr=crv=Ed448"}, full: true, format: "pkcs8", want: "PRIVATE KEY"},
+		{gen: []string{"-okp", "-setstr=crv=X448"}, format: "pkix", want: "PUBLIC KEY"},
+		{gen: []string{"-okp", "-setstr=crv=Ed448"}, format: "pkcs1"},
+	} {
+		t.Run(strings.Join(test.gen, " ")+" full="+strconv.FormatBool(test.full)+" "+test.format, func(t *testing.T) {
+			set := jwk.NewSet()
+			if err := handleGen(append(test.gen, "-setstr=kid=test"), set); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-pem", "-pem.format=" + test.format}
+			if test.full {
+				args = append(args, "-fullkey")
+			}
+
+			if test.want == "" {
+				err := handleWrite(append(args, "-path="+filepath.Join(t.TempDir(), "out")), set)
+				want := "--pem.format=" + test.format + " only supports " + pemFormats[test.format] + `, cannot write key "test"`
+				if err == nil || err.Error() != want {
+					t.Errorf("got error %v, expected %q", err, want)
+				}
+				return
+			}
+			contents := writeToFile(t, set, args...)
+			block, rest := pem.Decode(contents)
+			if block == nil || len(rest) != 0 {
+				t.Fatal("expected a single PEM block")
+			}
+			if block.Type != test.want {
+				t.Errorf("got a %q block, expected %q", block.Type, test.want)
+			}
+			if _, err := parsePEM(contents); err != nil {
+				t.Errorf("cannot parse the written key: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // x5t is defined as the SHA-1 thumbprint
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/cert"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// certOptions are the settings for a self-signed certificate or a certificate signing request.
+type certOptions struct {
+	subject  pkix.Name
+	validity time.Duration
+	dnsNames []string
+	emails   []string
+	ips      []net.IP
+	uris     []*neturl.URL
+	keyUsage x509.KeyUsage
+	// extKeyUsage is only used for certificate signing requests
+	extKeyUsage []asn1.ObjectIdentifier
+}
+
+// defaultCertValidity is the validity of a self-signed certificate when no -x509.validity is given.
+const defaultCertValidity = 365 * 24 * time.Hour
+
+// serialNumberBits is the size of the random serial number of a certificate, as recommended by the CA/Browser Forum.
+const serialNumberBits = 128
+
+// parseDistinguishedName parses a distinguished name of comma-separated type=value attributes, such as CN=example,O=Example Corp. A comma or backslash within a value is escaped with a backslash.
+func parseDistinguishedName(value string) (pkix.Name, error) {
+	var name pkix.Name
+	var attrs []string
+	var attr strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && i+1 < len(value):
+			i++
+			attr.WriteByte(value[i])
+		case c == ',':
+			attrs = append(attrs, attr.String())
+			attr.Reset()
+		default:
+			attr.WriteByte(c)
+		}
+	}
+	attrs = append(attrs, attr.String())
+
+	for _, attr := range attrs {
+		typ, val, found := strings.Cut(attr, "=")
+		typ, val = strings.TrimSpace(typ), strings.TrimSpace(val)
+		if !found || val == "" {
+			return name, errors.New("distinguished name attributes must be type=value format")
+		}
+		switch strings.ToUpper(typ) {
+		case "CN":
+			if name.CommonName != "" {
+				return name, errors.New("duplicate CN in distinguished name")
+			}
+			name.CommonName = val
+		case "SERIALNUMBER":
+			if name.SerialNumber != "" {
+				return name, errors.New("duplicate SERIALNUMBER in distinguished name")
+			}
+			name.SerialNumber = val
+		case "O":
+			name.Organization = append(name.Organization, val)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, val)
+		case "C":
+			name.Country = append(name.Country, val)
+		case "L":
+			name.Locality = append(name.Locality, val)
+		case "ST":
+			name.Province = append(name.Province, val)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, val)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, val)
+		default:
+			return name, errors.New("unsupported distinguished name attribute " + typ)
+		}
+	}
+	return name, nil
+}
+
+// addSubjectAltName adds a subject alternative name, which is an IP address, a URI if it contains ://, an email address if it contains @, or otherwise a DNS name.
+func (o *certOptions) addSubjectAltName(value string) error {
+	switch {
+	case net.ParseIP(value) != nil:
+		o.ips = append(o.ips, net.ParseIP(value))
+	case strings.Contains(value, "://"):
+		uri, err := neturl.Parse(value)
+		if err != nil {
+			return err
+		}
+		o.uris = append(o.uris, uri)
+	case strings.Contains(value, "@"):
+		o.emails = append(o.emails, value)
+	default:
+		o.dnsNames = append(o.dnsNames, value)
+	}
+	return nil
+}
+
+func parseKeyUsage(value string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+	for _, name := range strings.Split(value, ",") {
+		bit := map[string]x509.KeyUsage{
+			"digitalSignature":  x509.KeyUsageDigitalSignature,
+			"contentCommitment": x509.KeyUsageContentCommitment,
+			"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+			"dataEncipherment":  x509.KeyUsageDataEncipherment,
+			"keyAgreement":      x509.KeyUsageKeyAgreement,
+			"keyCertSign":       x509.KeyUsageCertSign,
+			"cRLSign":           x509.KeyUsageCRLSign,
+		}[name]
+		if bit == 0 {
+			return 0, errors.New("unsupported key usage " + name)
+		}
+		usage |= bit
+	}
+	return usage, nil
+}
+
+// extKeyUsageOIDs are the extended key usages from RFC 5280.
+var extKeyUsageOIDs = map[string]asn1.ObjectIdentifier{
+	"serverAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	"clientAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	"codeSigning":     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	"emailProtection": {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	"timeStamping":    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	"OCSPSigning":     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// OIDs of the certificate extensions requested in a CSR.
+var (
+	oidExtKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+func parseExtKeyUsage(value string) ([]asn1.ObjectIdentifier, error) {
+	var usages []asn1.ObjectIdentifier
+	for _, name := range strings.Split(value, ",") {
+		oid, known := extKeyUsageOIDs[name]
+		if !known {
+			return nil, errors.New("unsupported extended key usage " + name)
+		}
+		usages = append(usages, oid)
+	}
+	return usages, nil
+}
+
+// createCSR creates a PKCS #10 certificate signing request for the private key, returning it in DER form.
+func createCSR(rawKey any, opts certOptions) ([]byte, error) {
+	signer, isSigner := rawKey.(crypto.Signer)
+	if !isSigner {
+		return nil, errors.New("unsupported key type for a certificate signing request")
+	}
+
+	// Unlike x509.Certificate, x509.CertificateRequest has no fields for key usages, so they're added as raw extensions
+	var extensions []pkix.Extension
+	if opts.keyUsage != 0 {
+		// The KeyUsage bit string numbers the bits from the most significant bit of the first byte
+		var bits [2]byte
+		bitLength := 0
+		//nolint:mnd // x509.KeyUsage has 9 bits, and there are 8 bits per byte
+		for i := range 9 {
+			if opts.keyUsage&(1<<i) != 0 {
+				bits[i/8] |= 0x80 >> (i % 8)
+				bitLength = i + 1
+			}
+		}
+		value, err := asn1.Marshal(asn1.BitString{Bytes: bits[:(bitLength+7)/8], BitLength: bitLength}) //nolint:mnd // bits per byte, rounding up
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtKeyUsage, Critical: true, Value: value})
+	}
+	if len(opts.extKeyUsage) > 0 {
+		value, err := asn1.Marshal(opts.extKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtExtKeyUsage, Value: value})
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:         opts.subject,
+		DNSNames:        opts.dnsNames,
+		EmailAddresses:  opts.emails,
+		IPAddresses:     opts.ips,
+		URIs:            opts.uris,
+		ExtraExtensions: extensions,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, signer)
+}
+
+// selfSign creates a self-signed certificate for the private key, returning it in DER form.
+func selfSign(rawKey any, opts certOptions) ([]byte, error) {
+	signer, isSigner := rawKey.(crypto.Signer)
+	if !isSigner {
+		return nil, errors.New("unsupported key type for a certificate")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialNumberBits))
+	if err != nil {
+		return nil, err
+	}
+	keyUsage := opts.keyUsage
+	if keyUsage == 0 {
+		keyUsage = x509.KeyUsageDigitalSignature
+		if _, isRSA := rawKey.(*rsa.PrivateKey); isRSA {
+			keyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               opts.subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(opts.validity),
+		KeyUsage:              keyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              opts.dnsNames,
+		EmailAddresses:        opts.emails,
+		IPAddresses:           opts.ips,
+		URIs:                  opts.uris,
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+}
+
+// setCertificate sets the x5c, x5t and x5t#S256 properties of the key to the certificate.
+func setCertificate(key jwk.Key, der []byte) error {
+	var chain cert.Chain
+	if err := chain.AddString(base64.StdEncoding.EncodeToString(der)); err != nil {
+		return err
+	}
+	if err := key.Set(jwk.X509CertChainKey, &chain); err != nil {
+		return err
+	}
+	sha1Sum := sha1.Sum(der) //nolint:gosec // see import
+	if err := key.Set(jwk.X509CertThumbprintKey, base64.RawURLEncoding.EncodeToString(sha1Sum[:])); err != nil {
+		return err
+	}
+	sha256Sum := sha256.Sum256(der)
+	return key.Set(jwk.X509CertThumbprintS256Key, base64.RawURLEncoding.EncodeToString(sha256Sum[:]))
+}